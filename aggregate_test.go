@@ -0,0 +1,420 @@
+package mock
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	. "github.com/kylejryan/mocument/mock"
+)
+
+// aggregate runs pipeline and decodes every result.
+func aggregate(t *testing.T, mockDocDB *MockDocDB, collection string, pipeline interface{}) []bson.M {
+	t.Helper()
+	cursor, err := mockDocDB.Aggregate(context.Background(), collection, pipeline)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	var results []bson.M
+	assert.NoError(t, cursor.All(context.Background(), &results))
+	return results
+}
+
+func TestAggregateCoreStages(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertMany("orders", []interface{}{
+		Document{"_id": 1, "customer": "alice", "status": "paid", "total": 30, "items": []interface{}{"pen", "ink"}, "address": Document{"city": "Paris", "zip": "75001"}},
+		Document{"_id": 2, "customer": "bob", "status": "paid", "total": 12.5, "items": []interface{}{"pad"}},
+		Document{"_id": 3, "customer": "carol", "status": "open", "total": 99, "items": []interface{}{}},
+		Document{"_id": 4, "customer": "dave", "status": "paid", "total": 45, "items": nil},
+		Document{"_id": 5, "customer": "erin", "status": "paid", "total": 8},
+	})
+	assert.NoError(t, err)
+
+	// $match, $sort, $skip, $limit and an inclusion $project with computed fields
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "status", Value: "paid"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "total", Value: -1}}}},
+		{{Key: "$skip", Value: 1}},
+		{{Key: "$limit", Value: 2}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "customer", Value: 1},
+			{Key: "withTax", Value: bson.D{{Key: "$multiply", Value: bson.A{"$total", 2}}}},
+			{Key: "label", Value: bson.D{{Key: "$concat", Value: bson.A{"order-", bson.D{{Key: "$toUpper", Value: "$customer"}}}}}},
+			{Key: "big", Value: bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$gte", Value: bson.A{"$total", 20}}}, true, false}}}},
+		}}},
+	}
+	assert.Equal(t, []bson.M{
+		{"customer": "alice", "withTax": int32(60), "label": "order-ALICE", "big": true},
+		{"customer": "bob", "withTax": 25.0, "label": "order-BOB", "big": false},
+	}, aggregate(t, mockDocDB, "orders", pipeline))
+
+	// Exclusion $project, $addFields with $$REMOVE, $set, $unset and $count
+	results := aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$match": bson.M{"_id": 1}},
+		{"$project": bson.M{"items": 0, "address.zip": 0}},
+		{"$addFields": bson.M{"city": "$address.city", "status": "$$REMOVE", "flags": bson.M{"vip": true}}},
+		{"$set": bson.M{"total": bson.M{"$add": bson.A{"$total", 5}}}},
+		{"$unset": bson.A{"address"}},
+	})
+	assert.Equal(t, []bson.M{{"_id": int32(1), "customer": "alice", "total": int32(35), "city": "Paris", "flags": bson.M{"vip": true}}}, results)
+
+	assert.Equal(t, []bson.M{{"paid": int32(4)}}, aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$match": bson.M{"status": "paid"}},
+		{"$count": "paid"},
+	}))
+	assert.Empty(t, aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$match": bson.M{"status": "refunded"}},
+		{"$count": "refunded"},
+	}))
+
+	// Including only _id keeps nothing else
+	assert.Equal(t, []bson.M{{"_id": int32(1)}, {"_id": int32(2)}}, aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$match": bson.M{"_id": bson.M{"$lte": 2}}},
+		{"$project": bson.M{"_id": 1}},
+	}))
+
+	// $replaceRoot promotes an embedded document
+	assert.Equal(t, []bson.M{{"city": "Paris", "zip": "75001"}}, aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$match": bson.M{"address": bson.M{"$exists": true}}},
+		{"$replaceRoot": bson.M{"newRoot": "$address"}},
+	}))
+	_, err = mockDocDB.Aggregate(context.Background(), "orders", []bson.M{{"$replaceRoot": bson.M{"newRoot": "$total"}}})
+	assert.Error(t, err)
+
+	// The stored documents are unchanged
+	docs, err := mockDocDB.FindDocument("orders", Document{"_id": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "paid", docs[0]["status"])
+	assert.Contains(t, docs[0]["address"], "zip")
+}
+
+func TestAggregateUnwind(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertMany("orders", []interface{}{
+		Document{"_id": 1, "items": []interface{}{"pen", "ink"}},
+		Document{"_id": 2, "items": "pad"},
+		Document{"_id": 3, "items": []interface{}{}},
+		Document{"_id": 4, "items": nil},
+		Document{"_id": 5},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []bson.M{
+		{"_id": int32(1), "items": "pen"},
+		{"_id": int32(1), "items": "ink"},
+		{"_id": int32(2), "items": "pad"},
+	}, aggregate(t, mockDocDB, "orders", []bson.M{{"$unwind": "$items"}}))
+
+	assert.Equal(t, []bson.M{
+		{"_id": int32(1), "items": "pen", "idx": int64(0)},
+		{"_id": int32(1), "items": "ink", "idx": int64(1)},
+		{"_id": int32(2), "items": "pad", "idx": nil},
+		{"_id": int32(3), "items": bson.A{}, "idx": nil},
+		{"_id": int32(4), "items": nil, "idx": nil},
+		{"_id": int32(5), "idx": nil},
+	}, aggregate(t, mockDocDB, "orders", []bson.M{{"$unwind": bson.M{
+		"path":                       "$items",
+		"includeArrayIndex":          "idx",
+		"preserveNullAndEmptyArrays": true,
+	}}}))
+
+	// The transaction fixture's line items can be totalled per product
+	transaction := loadJSONFixture("testdata/sample_transaction.json", t)
+	_, err = mockDocDB.InsertDocument("transactions", transaction)
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{
+		{"product": "prod002", "lineTotal": 100.5},
+		{"product": "prod001", "lineTotal": 50.25},
+	}, aggregate(t, mockDocDB, "transactions", []bson.M{
+		{"$unwind": "$Items"},
+		{"$project": bson.M{"_id": 0, "product": "$Items.ProductID", "lineTotal": bson.M{"$multiply": bson.A{"$Items.Quantity", "$Items.Price"}}}},
+		{"$sort": bson.M{"lineTotal": -1}},
+	}))
+}
+
+func TestAggregateErrorsAndCursor(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+	ctx := context.Background()
+
+	var docs []interface{}
+	for i := 0; i < 5; i++ {
+		docs = append(docs, Document{"_id": i})
+	}
+	_, err := mockDocDB.InsertMany("items", docs)
+	assert.NoError(t, err)
+
+	cursor, err := mockDocDB.Aggregate(ctx, "items", mongo.Pipeline{}, options.Aggregate().SetBatchSize(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cursor.RemainingBatchLength())
+	count := 0
+	for cursor.Next(ctx) {
+		count++
+	}
+	assert.Equal(t, 5, count)
+
+	cursor, err = mockDocDB.Aggregate(ctx, "missing", []bson.M{{"$match": bson.M{}}})
+	assert.NoError(t, err)
+	assert.False(t, cursor.Next(ctx))
+
+	for _, pipeline := range []interface{}{
+		bson.M{"$match": bson.M{}},
+		[]bson.M{{"$bogus": 1}},
+		[]bson.M{{"$match": bson.M{}, "$limit": 1}},
+		[]bson.M{{"$limit": 0}},
+		[]bson.M{{"$skip": -1}},
+		[]bson.M{{"$count": "$n"}},
+		[]bson.M{{"$unwind": "items"}},
+		[]bson.M{{"$sort": bson.M{"a": 1, "b": 1}}},
+		[]bson.M{{"$project": bson.M{}}},
+		[]bson.M{{"$project": bson.M{"a": 0, "b": "$x"}}},
+		[]bson.M{{"$project": bson.M{"a": bson.M{"$unknown": 1}}}},
+		[]bson.M{{"$addFields": bson.M{"a": bson.M{"$divide": bson.A{1, 0}}}}},
+	} {
+		_, err := mockDocDB.Aggregate(ctx, "items", pipeline)
+		assert.Error(t, err, "%v", pipeline)
+	}
+}
+
+func TestAggregateGroup(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	transaction := loadJSONFixture("testdata/sample_transaction.json", t)
+	rows := []struct {
+		id, customer, currency string
+		amount                 interface{}
+	}{
+		{"txn001", "cust123", "USD", 150.75},
+		{"txn002", "cust123", "USD", 49.25},
+		{"txn003", "cust123", "EUR", 20},
+		{"txn004", "cust456", "USD", nil},
+		{"txn005", "cust456", "USD", 10},
+	}
+	for _, row := range rows {
+		doc := Document{}
+		for key, value := range transaction {
+			doc[key] = value
+		}
+		doc["_id"], doc["ID"], doc["CustomerID"], doc["Currency"] = row.id, row.id, row.customer, row.currency
+		if row.amount == nil {
+			delete(doc, "Amount")
+		} else {
+			doc["Amount"] = row.amount
+		}
+		_, err := mockDocDB.InsertDocument("transactions", doc)
+		assert.NoError(t, err)
+	}
+
+	// Revenue rollups by customer and currency
+	results := aggregate(t, mockDocDB, "transactions", []bson.M{
+		{"$group": bson.M{
+			"_id":      bson.M{"customer": "$CustomerID", "currency": "$Currency"},
+			"revenue":  bson.M{"$sum": "$Amount"},
+			"average":  bson.M{"$avg": "$Amount"},
+			"smallest": bson.M{"$min": "$Amount"},
+			"largest":  bson.M{"$max": "$Amount"},
+			"first":    bson.M{"$first": "$ID"},
+			"last":     bson.M{"$last": "$Amount"},
+			"amounts":  bson.M{"$push": "$Amount"},
+			"statuses": bson.M{"$addToSet": "$Status"},
+			"count":    bson.M{"$count": bson.M{}},
+		}},
+		{"$sort": bson.D{{Key: "_id.customer", Value: 1}, {Key: "_id.currency", Value: -1}}},
+	})
+	assert.Equal(t, []bson.M{
+		{
+			"_id": bson.M{"customer": "cust123", "currency": "USD"}, "revenue": 200.0, "average": 100.0,
+			"smallest": 49.25, "largest": 150.75, "first": "txn001", "last": 49.25,
+			"amounts": bson.A{150.75, 49.25}, "statuses": bson.A{"Pending"}, "count": int32(2),
+		},
+		{
+			"_id": bson.M{"customer": "cust123", "currency": "EUR"}, "revenue": int32(20), "average": 20.0,
+			"smallest": int32(20), "largest": int32(20), "first": "txn003", "last": int32(20),
+			"amounts": bson.A{int32(20)}, "statuses": bson.A{"Pending"}, "count": int32(1),
+		},
+		{
+			"_id": bson.M{"customer": "cust456", "currency": "USD"}, "revenue": int32(10), "average": 10.0,
+			"smallest": int32(10), "largest": int32(10), "first": "txn004", "last": int32(10),
+			"amounts": bson.A{int32(10)}, "statuses": bson.A{"Pending"}, "count": int32(2),
+		},
+	}, results)
+
+	// Null and missing values: $avg, $min and $max ignore them, $first and $last keep them as null
+	results = aggregate(t, mockDocDB, "transactions", []bson.M{
+		{"$match": bson.M{"ID": "txn004"}},
+		{"$group": bson.M{
+			"_id":     "$CustomerID",
+			"total":   bson.M{"$sum": "$Amount"},
+			"average": bson.M{"$avg": "$Amount"},
+			"largest": bson.M{"$max": "$Amount"},
+			"first":   bson.M{"$first": "$Amount"},
+			"amounts": bson.M{"$push": "$Amount"},
+		}},
+	})
+	assert.Equal(t, []bson.M{{"_id": "cust456", "total": int32(0), "average": nil, "largest": nil, "first": nil, "amounts": bson.A{}}}, results)
+
+	// A constant _id groups everything; a missing one groups as null
+	results = aggregate(t, mockDocDB, "transactions", []bson.M{
+		{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": 1}, "customers": bson.M{"$addToSet": "$CustomerID"}}},
+	})
+	assert.Equal(t, []bson.M{{"_id": nil, "n": int32(5), "customers": bson.A{"cust123", "cust456"}}}, results)
+	results = aggregate(t, mockDocDB, "transactions", []bson.M{{"$group": bson.M{"_id": "$Missing"}}})
+	assert.Equal(t, []bson.M{{"_id": nil}}, results)
+
+	// Integer sums widen to long and then to double, and decimals win over both
+	fifteen, err := primitive.ParseDecimal128("15")
+	assert.NoError(t, err)
+	results = aggregate(t, mockDocDB, "transactions", []bson.M{
+		{"$group": bson.M{
+			"_id":      nil,
+			"long":     bson.M{"$sum": bson.M{"$literal": int64(1) << 40}},
+			"overflow": bson.M{"$sum": bson.M{"$literal": int64(math.MaxInt64)}},
+			"decimal":  bson.M{"$sum": bson.M{"$literal": fifteen}},
+			"avg":      bson.M{"$avg": bson.M{"$literal": int32(3)}},
+		}},
+	})
+	assert.Len(t, results, 1)
+	assert.Equal(t, int64(5)<<40, results[0]["long"])
+	assert.Equal(t, float64(math.MaxInt64)*5, results[0]["overflow"])
+	assert.Equal(t, "75", results[0]["decimal"].(primitive.Decimal128).String())
+	assert.Equal(t, 3.0, results[0]["avg"])
+
+	for _, group := range []bson.M{
+		{"total": bson.M{"$sum": "$Amount"}},
+		{"_id": nil, "a.b": bson.M{"$sum": 1}},
+		{"_id": nil, "total": bson.M{"$median": "$Amount"}},
+		{"_id": nil, "total": bson.M{"$sum": 1, "$avg": 1}},
+		{"_id": nil, "n": bson.M{"$count": 1}},
+	} {
+		_, err := mockDocDB.Aggregate(context.Background(), "transactions", []bson.M{{"$group": group}})
+		assert.Error(t, err, "%v", group)
+	}
+}
+
+func TestAggregateLookup(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertMany("customers", []interface{}{
+		Document{"_id": "cust123", "name": "Ada", "tier": "gold"},
+		Document{"_id": "cust456", "name": "Bob", "tier": "silver"},
+	})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertMany("products", []interface{}{
+		Document{"_id": "prod001", "name": "Pen", "stock": 5},
+		Document{"_id": "prod002", "name": "Ink", "stock": 0},
+		Document{"_id": "prod003", "name": "Pad", "stock": 12},
+	})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertMany("orders", []interface{}{
+		Document{"_id": 1, "customerId": "cust123", "productIds": []interface{}{"prod001", "prod002"}, "minStock": 1},
+		Document{"_id": 2, "customerId": "cust456", "productIds": "prod003", "minStock": 20},
+		Document{"_id": 3, "customerId": "cust999", "productIds": []interface{}{}},
+	})
+	assert.NoError(t, err)
+
+	// localField/foreignField joins, with an array localField matching any of its elements
+	results := aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$lookup": bson.M{"from": "customers", "localField": "customerId", "foreignField": "_id", "as": "customer"}},
+		{"$lookup": bson.M{"from": "products", "localField": "productIds", "foreignField": "_id", "as": "products"}},
+		{"$project": bson.M{"customer.name": 1, "products.name": 1}},
+	})
+	assert.Equal(t, []bson.M{
+		{"_id": int32(1), "customer": bson.A{bson.M{"name": "Ada"}}, "products": bson.A{bson.M{"name": "Pen"}, bson.M{"name": "Ink"}}},
+		{"_id": int32(2), "customer": bson.A{bson.M{"name": "Bob"}}, "products": bson.A{bson.M{"name": "Pad"}}},
+		{"_id": int32(3), "customer": bson.A{}, "products": bson.A{}},
+	}, results)
+
+	// A missing localField matches foreign documents where the field is null or missing
+	_, err = mockDocDB.InsertDocument("notes", Document{"_id": "n1", "text": "unassigned"})
+	assert.NoError(t, err)
+	results = aggregate(t, mockDocDB, "customers", []bson.M{
+		{"$match": bson.M{"_id": "cust123"}},
+		{"$lookup": bson.M{"from": "notes", "localField": "missing", "foreignField": "orderId", "as": "notes"}},
+	})
+	assert.Equal(t, bson.A{bson.M{"_id": "n1", "text": "unassigned"}}, results[0]["notes"])
+
+	// The pipeline/let form runs a correlated sub-pipeline per document
+	results = aggregate(t, mockDocDB, "orders", []bson.M{
+		{"$match": bson.M{"_id": bson.M{"$in": bson.A{1, 2}}}},
+		{"$lookup": bson.M{
+			"from": "products",
+			"let":  bson.M{"ids": "$productIds", "minStock": "$minStock"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$in": bson.A{"$_id", bson.M{"$cond": bson.A{bson.M{"$isArray": "$$ids"}, "$$ids", bson.A{"$$ids"}}}}},
+					bson.M{"$gte": bson.A{"$stock", "$$minStock"}},
+				}}}},
+				bson.M{"$project": bson.M{"_id": 0, "name": 1}},
+			},
+			"as": "inStock",
+		}},
+		{"$project": bson.M{"inStock": 1}},
+	})
+	assert.Equal(t, []bson.M{
+		{"_id": int32(1), "inStock": bson.A{bson.M{"name": "Pen"}}},
+		{"_id": int32(2), "inStock": bson.A{}},
+	}, results)
+
+	// localField/foreignField combined with a pipeline, and nested lookups that see outer variables
+	results = aggregate(t, mockDocDB, "customers", []bson.M{
+		{"$match": bson.M{"_id": "cust123"}},
+		{"$lookup": bson.M{
+			"from":         "orders",
+			"localField":   "_id",
+			"foreignField": "customerId",
+			"let":          bson.M{"tier": "$tier"},
+			"pipeline": bson.A{
+				bson.M{"$lookup": bson.M{
+					"from":     "products",
+					"let":      bson.M{"ids": "$productIds"},
+					"pipeline": bson.A{bson.M{"$match": bson.M{"$expr": bson.M{"$in": bson.A{"$_id", "$$ids"}}}}, bson.M{"$project": bson.M{"_id": 0, "name": 1, "tier": "$$tier"}}},
+					"as":       "items",
+				}},
+				bson.M{"$project": bson.M{"items": 1}},
+			},
+			"as": "orders",
+		}},
+		{"$project": bson.M{"orders": 1}},
+	})
+	assert.Equal(t, []bson.M{{"_id": "cust123", "orders": bson.A{bson.M{"_id": int32(1), "items": bson.A{
+		bson.M{"name": "Pen", "tier": "gold"},
+		bson.M{"name": "Ink", "tier": "gold"},
+	}}}}}, results)
+
+	// $expr also works in plain filters, and an unknown collection joins nothing
+	docs, err := mockDocDB.FindDocument("products", Document{"$expr": Document{"$gt": bson.A{"$stock", 4}}})
+	assert.NoError(t, err)
+	assert.Len(t, docs, 2)
+	results = aggregate(t, mockDocDB, "customers", []bson.M{
+		{"$lookup": bson.M{"from": "missing", "localField": "_id", "foreignField": "customerId", "as": "joined"}},
+	})
+	assert.Equal(t, bson.A{}, results[0]["joined"])
+
+	for _, lookup := range []bson.M{
+		{"localField": "a", "foreignField": "b", "as": "c"},
+		{"from": "products", "localField": "a", "foreignField": "b"},
+		{"from": "products", "localField": "a", "as": "c"},
+		{"from": "products", "as": "c"},
+		{"from": "products", "as": "c", "pipeline": bson.A{bson.M{"$bogus": 1}}},
+		{"from": "products", "as": "c", "pipeline": bson.A{}, "let": bson.M{"Bad": 1}},
+		{"from": "products", "as": "c", "pipeline": bson.A{bson.M{"$match": bson.M{"$expr": "$$undefined"}}}},
+		{"from": "products", "as": "c", "pipeline": bson.A{}, "extra": 1},
+	} {
+		_, err := mockDocDB.Aggregate(context.Background(), "orders", []bson.M{{"$lookup": lookup}})
+		assert.Error(t, err, "%v", lookup)
+	}
+}
@@ -0,0 +1,414 @@
+package mock
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	. "github.com/kylejryan/mocument/mock"
+)
+
+func TestFindWithSortSkipAndLimit(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	docs := []Document{
+		{"_id": 1, "name": "Alice", "city": "Paris", "age": 30},
+		{"_id": 2, "name": "Bob", "city": "Berlin", "age": int64(25)},
+		{"_id": 3, "name": "Charlie", "city": "Paris", "age": 35.5},
+		{"_id": 4, "name": "Dana", "city": "Berlin", "age": "unknown"},
+		{"_id": 5, "name": "Eve", "city": "Paris"},
+	}
+	for _, doc := range docs {
+		_, err := mockDocDB.InsertDocument("users", doc)
+		assert.NoError(t, err)
+	}
+
+	names := func(results []Document) []interface{} {
+		var out []interface{}
+		for _, doc := range results {
+			out = append(out, doc["name"])
+		}
+		return out
+	}
+
+	// Missing fields sort first, then numbers of any type, then strings
+	results, err := mockDocDB.FindDocument("users", nil, options.Find().SetSort(bson.D{{Key: "age", Value: 1}}))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"Eve", "Bob", "Alice", "Charlie", "Dana"}, names(results))
+
+	// Later keys break ties in earlier ones, in the order given
+	results, err = mockDocDB.FindDocument("users", nil, options.Find().SetSort(bson.D{{Key: "city", Value: -1}, {Key: "name", Value: 1}}))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"Alice", "Charlie", "Eve", "Bob", "Dana"}, names(results))
+
+	// Skip and limit apply after the filter and sort
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: -1}}).SetSkip(1).SetLimit(2)
+	results, err = mockDocDB.FindDocument("users", Document{"city": "Paris"}, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"Charlie", "Alice"}, names(results))
+
+	// A negative limit is treated as its absolute value and options merge
+	results, err = mockDocDB.FindDocument("users", nil, options.Find().SetLimit(-2), options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"Eve", "Dana"}, names(results))
+
+	results, err = mockDocDB.FindDocument("users", nil, options.Find().SetSkip(10))
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	_, err = mockDocDB.FindDocument("users", nil, options.Find().SetSkip(-1))
+	assert.Error(t, err)
+	_, err = mockDocDB.FindDocument("users", nil, options.Find().SetSort(bson.D{{Key: "age", Value: 2}}))
+	assert.Error(t, err)
+
+	// A map has no order, so it can only name a single key
+	results, err = mockDocDB.FindDocument("users", nil, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"Eve"}, names(results))
+	_, err = mockDocDB.FindDocument("users", nil, options.Find().SetSort(bson.M{"city": -1, "name": 1}))
+	assert.Error(t, err)
+}
+
+func TestFindWithProjection(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertDocument("users", Document{
+		"_id":      1,
+		"name":     "Alice",
+		"password": "secret",
+		"address":  Document{"city": "Paris", "zip": "75001"},
+		"tags":     []interface{}{"a", "b", "c", "d"},
+		"scores": []interface{}{
+			Document{"subject": "math", "score": 70},
+			Document{"subject": "art", "score": 95},
+			Document{"subject": "music", "score": 90},
+		},
+	})
+	assert.NoError(t, err)
+
+	find := func(projection interface{}) Document {
+		results, err := mockDocDB.FindDocument("users", Document{"_id": 1}, options.Find().SetProjection(projection))
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+		return results[0]
+	}
+
+	// Inclusion keeps _id unless it is excluded
+	assert.Equal(t, Document{"_id": 1, "name": "Alice", "address": map[string]interface{}{"city": "Paris"}},
+		find(Document{"name": 1, "address.city": true}))
+	assert.Equal(t, Document{"name": "Alice"}, find(Document{"name": 1, "_id": 0}))
+	assert.Equal(t, Document{"_id": 1}, find(Document{"_id": 1}))
+	assert.Equal(t, Document{"_id": 1, "name": "Alice"}, find(Document{"_id": 1, "password": 0, "address": 0, "scores": 0, "tags": 0}))
+
+	// Inclusion through an array of documents projects each element
+	assert.Equal(t, Document{"scores": []interface{}{
+		map[string]interface{}{"subject": "math"},
+		map[string]interface{}{"subject": "art"},
+		map[string]interface{}{"subject": "music"},
+	}}, find(Document{"scores.subject": 1, "_id": 0}))
+
+	// Exclusion returns everything else
+	doc := find(Document{"password": 0, "address.zip": 0, "scores": 0, "tags": 0})
+	assert.Equal(t, Document{"_id": 1, "name": "Alice", "address": map[string]interface{}{"city": "Paris"}}, doc)
+
+	// $slice takes the first n, the last n, or n after skipping
+	assert.Equal(t, []interface{}{"a", "b"}, find(Document{"tags": Document{"$slice": 2}})["tags"])
+	assert.Equal(t, []interface{}{"c", "d"}, find(Document{"tags": Document{"$slice": -2}})["tags"])
+	doc = find(Document{"tags": Document{"$slice": []interface{}{1, 2}}, "password": 0})
+	assert.Equal(t, []interface{}{"b", "c"}, doc["tags"])
+	assert.NotContains(t, doc, "password")
+	assert.Contains(t, doc, "name")
+
+	// $elemMatch returns the first matching element only
+	doc = find(Document{"scores": Document{"$elemMatch": Document{"score": Document{"$gte": 90}}}})
+	assert.Equal(t, Document{"_id": 1, "scores": []interface{}{map[string]interface{}{"subject": "art", "score": 95}}}, doc)
+	doc = find(Document{"name": 1, "scores": Document{"$elemMatch": Document{"score": Document{"$gt": 100}}}})
+	assert.Equal(t, Document{"_id": 1, "name": "Alice"}, doc)
+
+	// The positional projection returns the element the query matched
+	results, err := mockDocDB.FindDocument("users", Document{"scores.subject": "music"},
+		options.Find().SetProjection(Document{"scores.$": 1, "_id": 0}))
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{{"scores": []interface{}{map[string]interface{}{"subject": "music", "score": 90}}}}, results)
+
+	// Projected results are copies
+	doc = find(Document{"address": 1})
+	doc["address"].(map[string]interface{})["city"] = "Lyon"
+	assert.Equal(t, "Paris", find(Document{"address.city": 1})["address"].(map[string]interface{})["city"])
+
+	// Invalid projections are rejected
+	for _, projection := range []Document{
+		{"name": 1, "password": 0},
+		{"address": 1, "address.city": 1},
+		{"tags": Document{"$unknown": 1}},
+		{"tags": Document{"$slice": "two"}},
+		{"name": "yes"},
+	} {
+		_, err := mockDocDB.FindDocument("users", nil, options.Find().SetProjection(projection))
+		assert.Error(t, err, "%v", projection)
+	}
+}
+
+func TestFindCursor(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+	ctx := context.Background()
+
+	var docs []interface{}
+	for i := 0; i < 5; i++ {
+		docs = append(docs, Document{"_id": i, "name": string(rune('a' + i)), "age": 20 + i})
+	}
+	_, err := mockDocDB.InsertMany("users", docs)
+	assert.NoError(t, err)
+
+	type user struct {
+		ID   int    `bson:"_id"`
+		Name string `bson:"name"`
+		Age  int    `bson:"age"`
+	}
+
+	// Next and Decode walk the results batch by batch
+	cursor, err := mockDocDB.Find(ctx, "users", Document{"age": Document{"$gte": 21}},
+		options.Find().SetSort(bson.D{{Key: "age", Value: -1}}).SetBatchSize(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cursor.RemainingBatchLength())
+	var seen []user
+	var remaining []int
+	for cursor.Next(ctx) {
+		var u user
+		assert.NoError(t, cursor.Decode(&u))
+		seen = append(seen, u)
+		remaining = append(remaining, cursor.RemainingBatchLength())
+	}
+	assert.NoError(t, cursor.Err())
+	assert.Equal(t, []user{{4, "e", 24}, {3, "d", 23}, {2, "c", 22}, {1, "b", 21}}, seen)
+	assert.Equal(t, []int{1, 0, 1, 0}, remaining)
+	assert.Equal(t, int64(0), cursor.ID())
+	assert.False(t, cursor.TryNext(ctx))
+	assert.NoError(t, cursor.Close(ctx))
+
+	// Current holds the raw document
+	cursor, err = mockDocDB.Find(ctx, "users", Document{"_id": 0})
+	assert.NoError(t, err)
+	assert.True(t, cursor.TryNext(ctx))
+	assert.Equal(t, "a", cursor.Current.Lookup("name").StringValue())
+	assert.False(t, cursor.Next(ctx))
+
+	// All decodes the remaining documents and closes the cursor
+	cursor, err = mockDocDB.Find(ctx, "users", nil, options.Find().SetBatchSize(1).SetSkip(1).SetLimit(3))
+	assert.NoError(t, err)
+	assert.True(t, cursor.Next(ctx))
+	var rest []user
+	assert.NoError(t, cursor.All(ctx, &rest))
+	assert.Equal(t, []user{{2, "c", 22}, {3, "d", 23}}, rest)
+	assert.False(t, cursor.Next(ctx))
+	assert.ErrorIs(t, cursor.All(ctx, &rest), ErrCursorClosed)
+	assert.Error(t, cursor.All(ctx, rest))
+
+	var all []Document
+	cursor, err = mockDocDB.Find(ctx, "users", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, cursor.All(ctx, &all))
+	assert.Len(t, all, 5)
+
+	// Results are a snapshot of the query
+	cursor, err = mockDocDB.Find(ctx, "users", nil, options.Find().SetBatchSize(1))
+	assert.NoError(t, err)
+	_, err = mockDocDB.DeleteMany("users", Document{})
+	assert.NoError(t, err)
+	count := 0
+	for cursor.Next(ctx) {
+		count++
+	}
+	assert.Equal(t, 5, count)
+
+	// A missing collection yields an empty cursor
+	cursor, err = mockDocDB.Find(ctx, "missing", nil)
+	assert.NoError(t, err)
+	assert.False(t, cursor.Next(ctx))
+	assert.NoError(t, cursor.Err())
+}
+
+func TestFindCursorBatchesAndCancellation(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	var docs []interface{}
+	for i := 0; i < 150; i++ {
+		docs = append(docs, Document{"_id": i})
+	}
+	_, err := mockDocDB.InsertMany("items", docs)
+	assert.NoError(t, err)
+
+	// Without a batch size the first batch holds 101 documents
+	cursor, err := mockDocDB.Find(context.Background(), "items", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 101, cursor.RemainingBatchLength())
+	assert.NotZero(t, cursor.ID())
+
+	// Cancellation is noticed when the next batch is needed
+	ctx, cancel := context.WithCancel(context.Background())
+	cursor, err = mockDocDB.Find(ctx, "items", nil, options.Find().SetBatchSize(10))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.True(t, cursor.Next(ctx))
+	}
+	cancel()
+	assert.False(t, cursor.Next(ctx))
+	assert.ErrorIs(t, cursor.Err(), context.Canceled)
+	assert.False(t, cursor.Next(context.Background()))
+
+	var rest []Document
+	cursor, err = mockDocDB.Find(context.Background(), "items", nil, options.Find().SetBatchSize(10))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, cursor.All(ctx, &rest), context.Canceled)
+
+	_, err = mockDocDB.Find(ctx, "items", nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFindOne(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+	ctx := context.Background()
+
+	_, err := mockDocDB.InsertMany("users", []interface{}{
+		Document{"_id": 1, "name": "Alice", "age": 30},
+		Document{"_id": 2, "name": "Bob", "age": 25},
+		Document{"_id": 3, "name": "Charlie", "age": 35},
+	})
+	assert.NoError(t, err)
+
+	var doc Document
+	assert.NoError(t, mockDocDB.FindOne(ctx, "users", Document{"age": Document{"$gt": 26}}).Decode(&doc))
+	assert.Equal(t, "Alice", doc["name"])
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "age", Value: -1}}).SetSkip(1).SetProjection(Document{"name": 1, "_id": 0})
+	doc = nil
+	assert.NoError(t, mockDocDB.FindOne(ctx, "users", nil, opts).Decode(&doc))
+	assert.Equal(t, Document{"name": "Alice"}, doc)
+
+	raw, err := mockDocDB.FindOne(ctx, "users", Document{"_id": 2}).Raw()
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", raw.Lookup("name").StringValue())
+
+	result := mockDocDB.FindOne(ctx, "users", Document{"name": "Zoe"})
+	assert.ErrorIs(t, result.Err(), mongo.ErrNoDocuments)
+	assert.ErrorIs(t, result.Decode(&doc), mongo.ErrNoDocuments)
+	assert.ErrorIs(t, mockDocDB.FindOne(ctx, "missing", nil).Err(), mongo.ErrNoDocuments)
+}
+
+func TestFindOneAndUpdate(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+	ctx := context.Background()
+
+	// Atomic counters return the value before or after the increment
+	after := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	for i := 1; i <= 3; i++ {
+		var counter struct {
+			Seq int `bson:"seq"`
+		}
+		err := mockDocDB.FindOneAndUpdate(ctx, "counters", Document{"_id": "orders"}, Document{"$inc": Document{"seq": 1}}, after).Decode(&counter)
+		assert.NoError(t, err)
+		assert.Equal(t, i, counter.Seq)
+	}
+	var doc Document
+	err := mockDocDB.FindOneAndUpdate(ctx, "counters", Document{"_id": "orders"}, Document{"$inc": Document{"seq": 1}}).Decode(&doc)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), doc["seq"])
+	count, err := mockDocDB.CountDocuments("counters", Document{"seq": 4})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// An upsert returns nothing unless the document after it is asked for
+	result := mockDocDB.FindOneAndUpdate(ctx, "counters", Document{"_id": "invoices"}, Document{"$inc": Document{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true))
+	assert.ErrorIs(t, result.Err(), mongo.ErrNoDocuments)
+	count, err = mockDocDB.CountDocuments("counters", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Jobs are claimed in priority order, one at a time
+	_, err = mockDocDB.InsertMany("jobs", []interface{}{
+		Document{"_id": "a", "priority": 1, "state": "queued"},
+		Document{"_id": "b", "priority": 3, "state": "queued"},
+		Document{"_id": "c", "priority": 2, "state": "queued"},
+	})
+	assert.NoError(t, err)
+	claim := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "priority", Value: -1}}).
+		SetProjection(Document{"state": 1}).
+		SetReturnDocument(options.After)
+	var claimed []interface{}
+	for {
+		var job Document
+		err := mockDocDB.FindOneAndUpdate(ctx, "jobs", Document{"state": "queued"}, Document{"$set": Document{"state": "running"}}, claim).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, Document{"_id": job["_id"], "state": "running"}, job)
+		claimed = append(claimed, job["_id"])
+	}
+	assert.Equal(t, []interface{}{"b", "c", "a"}, claimed)
+
+	// Nothing matching without upsert, and invalid updates, are reported
+	result = mockDocDB.FindOneAndUpdate(ctx, "jobs", Document{"state": "queued"}, Document{"$set": Document{"state": "running"}})
+	assert.ErrorIs(t, result.Err(), mongo.ErrNoDocuments)
+	result = mockDocDB.FindOneAndUpdate(ctx, "jobs", Document{"_id": "a"}, Document{"$set": Document{"_id": "z"}})
+	assert.Error(t, result.Err())
+	assert.NotErrorIs(t, result.Err(), mongo.ErrNoDocuments)
+}
+
+func TestFindOneAndReplaceAndDelete(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+	ctx := context.Background()
+
+	_, err := mockDocDB.InsertMany("users", []interface{}{
+		Document{"_id": 1, "name": "Alice", "age": 30},
+		Document{"_id": 2, "name": "Bob", "age": 25},
+	})
+	assert.NoError(t, err)
+
+	// The replacement keeps the _id and drops the other fields
+	var doc Document
+	err = mockDocDB.FindOneAndReplace(ctx, "users", Document{"name": "Alice"}, Document{"name": "Alicia"},
+		options.FindOneAndReplace().SetReturnDocument(options.After)).Decode(&doc)
+	assert.NoError(t, err)
+	assert.Equal(t, Document{"_id": int32(1), "name": "Alicia"}, doc)
+
+	doc = nil
+	err = mockDocDB.FindOneAndReplace(ctx, "users", Document{"_id": 2}, Document{"name": "Robert"}).Decode(&doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", doc["name"])
+
+	result := mockDocDB.FindOneAndReplace(ctx, "users", Document{"_id": 2}, Document{"$set": Document{"name": "Rob"}})
+	assert.Error(t, result.Err())
+	result = mockDocDB.FindOneAndReplace(ctx, "users", Document{"_id": 2}, Document{"_id": 3, "name": "Rob"})
+	assert.Error(t, result.Err())
+
+	// An upserted replacement takes the _id from the filter
+	doc = nil
+	err = mockDocDB.FindOneAndReplace(ctx, "users", Document{"_id": 7, "name": "Gina"}, Document{"age": 40},
+		options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)).Decode(&doc)
+	assert.NoError(t, err)
+	assert.Equal(t, Document{"_id": int32(7), "age": int32(40)}, doc)
+
+	// FindOneAndDelete returns the removed document
+	doc = nil
+	err = mockDocDB.FindOneAndDelete(ctx, "users", nil, options.FindOneAndDelete().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&doc)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(7), doc["_id"])
+	count, err := mockDocDB.CountDocuments("users", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.ErrorIs(t, mockDocDB.FindOneAndDelete(ctx, "users", Document{"_id": 7}).Err(), mongo.ErrNoDocuments)
+}
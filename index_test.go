@@ -0,0 +1,450 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	. "github.com/kylejryan/mocument/mock"
+)
+
+func TestCreateAndListIndexes(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	name, err := mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "email_1", name)
+
+	name, err = mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys: bson.D{{Key: "lastName", Value: 1}, {Key: "age", Value: -1}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "lastName_1_age_-1", name)
+
+	name, err = mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys: bson.D{{Key: "nickname", Value: 1}},
+		Options: options.Index().SetName("nick").SetSparse(true).
+			SetPartialFilterExpression(bson.M{"active": true}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "nick", name)
+
+	// Creating the same index again is a no-op, but a conflicting one is not
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.NoError(t, err)
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{Keys: bson.D{{Key: "email", Value: 1}}})
+	assert.Error(t, err)
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{Keys: bson.M{"a": 1, "b": 1}})
+	assert.Error(t, err)
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{Keys: bson.D{{Key: "a", Value: "text"}}})
+	assert.Error(t, err)
+
+	specs, err := mockDocDB.ListIndexes("users")
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{
+		{"v": int32(2), "key": bson.D{{Key: "_id", Value: int32(1)}}, "name": "_id_"},
+		{"v": int32(2), "key": bson.D{{Key: "email", Value: int32(1)}}, "name": "email_1", "unique": true},
+		{"v": int32(2), "key": bson.D{{Key: "lastName", Value: int32(1)}, {Key: "age", Value: int32(-1)}}, "name": "lastName_1_age_-1"},
+		{"v": int32(2), "key": bson.D{{Key: "nickname", Value: int32(1)}}, "name": "nick", "sparse": true,
+			"partialFilterExpression": Document{"active": true}},
+	}, specs)
+
+	assert.Error(t, mockDocDB.DropIndex("users", "_id_"))
+	assert.Error(t, mockDocDB.DropIndex("users", "missing"))
+	assert.NoError(t, mockDocDB.DropIndex("users", "lastName_1_age_-1"))
+	specs, err = mockDocDB.ListIndexes("users")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(specs))
+	assert.NoError(t, mockDocDB.DropIndex("users", "*"))
+	specs, err = mockDocDB.ListIndexes("users")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(specs))
+}
+
+func TestUniqueIndexEnforcement(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertMany("users", []interface{}{
+		Document{"email": "ada@example.com", "tags": []interface{}{"a", "b"}},
+		Document{"email": "bob@example.com", "tags": []interface{}{"c"}},
+		Document{"name": "no email"},
+	})
+	assert.NoError(t, err)
+
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.NoError(t, err)
+
+	_, err = mockDocDB.InsertDocument("users", Document{"email": "ada@example.com"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Contains(t, err.Error(), `index: email_1 dup key: { email: "ada@example.com" }`)
+
+	// A missing field indexes as null, so only one document may lack it
+	_, err = mockDocDB.InsertDocument("users", Document{"name": "also no email"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+
+	// Updates are checked too and leave the collection unchanged on failure
+	_, err = mockDocDB.UpdateOne("users", Document{"email": "bob@example.com"},
+		Document{"$set": Document{"email": "ada@example.com"}})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	results, err := mockDocDB.FindDocument("users", Document{"email": "bob@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// Multikey unique indexes treat each array element as a key
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys:    bson.D{{Key: "tags", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("users", Document{"email": "cy@example.com", "tags": []interface{}{"d", "b"}})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	// Sparse indexes skip documents without the field
+	_, err = mockDocDB.InsertDocument("users", Document{"email": "dee@example.com"})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("users", Document{"email": "eve@example.com"})
+	assert.NoError(t, err)
+
+	// A unique index cannot be built over existing duplicates
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+}
+
+func TestPartialAndCompoundUniqueIndexes(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.CreateIndex("accounts", mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"deleted": bson.M{"$ne": true}}),
+	})
+	assert.NoError(t, err)
+	_, err = mockDocDB.CreateIndex("accounts", mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "number", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.NoError(t, err)
+
+	// Only live accounts must have unique usernames
+	_, err = mockDocDB.InsertDocument("accounts", Document{"username": "ada", "deleted": true, "tenant": "a", "number": 1})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("accounts", Document{"username": "ada", "tenant": "a", "number": 2})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("accounts", Document{"username": "ada", "tenant": "b", "number": 1})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+
+	// Compound keys only collide when every field matches
+	_, err = mockDocDB.InsertDocument("accounts", Document{"username": "bob", "tenant": "b", "number": 1})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("accounts", Document{"username": "cy", "tenant": "a", "number": 1.0})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Contains(t, err.Error(), "index: tenant_1_number_1 dup key: { tenant: \"a\", number: 1 }")
+}
+
+func TestExplainUsesIndexes(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	var docs []interface{}
+	for i := 0; i < 100; i++ {
+		docs = append(docs, Document{"_id": i, "age": i % 50, "city": []string{"Paris", "Rome", "Oslo", "Lima"}[i%4]})
+	}
+	_, err := mockDocDB.InsertMany("users", docs)
+	assert.NoError(t, err)
+
+	explain := func(filter Document) (Document, Document) {
+		plan, err := mockDocDB.Explain("users", filter)
+		assert.NoError(t, err)
+		return plan["queryPlanner"].(Document)["winningPlan"].(Document), plan["executionStats"].(Document)
+	}
+
+	winningPlan, stats := explain(Document{"age": 7})
+	assert.Equal(t, "COLLSCAN", winningPlan["stage"])
+	assert.Equal(t, 100, stats["totalDocsExamined"])
+	assert.Equal(t, 0, stats["totalKeysExamined"])
+	assert.Equal(t, 2, stats["nReturned"])
+
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{Keys: bson.D{{Key: "age", Value: 1}}})
+	assert.NoError(t, err)
+
+	winningPlan, stats = explain(Document{"age": 7})
+	assert.Equal(t, "IXSCAN", winningPlan["stage"])
+	assert.Equal(t, "age_1", winningPlan["indexName"])
+	assert.Equal(t, 2, stats["totalKeysExamined"])
+	assert.Equal(t, 2, stats["totalDocsExamined"])
+	assert.Equal(t, 2, stats["nReturned"])
+
+	winningPlan, stats = explain(Document{"age": Document{"$gte": 45, "$lt": 48}, "city": "Paris"})
+	assert.Equal(t, "age_1", winningPlan["indexName"])
+	assert.Equal(t, 6, stats["totalKeysExamined"])
+	assert.Equal(t, 6, stats["totalDocsExamined"])
+	assert.Equal(t, 1, stats["nReturned"])
+
+	// The _id index wins when it selects fewer keys
+	winningPlan, stats = explain(Document{"_id": Document{"$in": []int{3, 4}}, "age": Document{"$gt": 0}})
+	assert.Equal(t, "_id_", winningPlan["indexName"])
+	assert.Equal(t, 2, stats["totalKeysExamined"])
+
+	// Conditions an index cannot answer fall back to a collection scan
+	winningPlan, _ = explain(Document{"age": Document{"$ne": 7}})
+	assert.Equal(t, "COLLSCAN", winningPlan["stage"])
+	winningPlan, _ = explain(Document{"$or": []Document{{"age": 1}, {"age": 2}}})
+	assert.Equal(t, "COLLSCAN", winningPlan["stage"])
+
+	// Compound indexes check the later fields against the keys before
+	// fetching documents
+	_, err = mockDocDB.CreateIndex("users", mongo.IndexModel{Keys: bson.D{{Key: "city", Value: 1}, {Key: "age", Value: 1}}})
+	assert.NoError(t, err)
+	winningPlan, stats = explain(Document{"city": "Rome", "age": Document{"$lt": 10}})
+	assert.Equal(t, "city_1_age_1", winningPlan["indexName"])
+	assert.Equal(t, 25, stats["totalKeysExamined"])
+	assert.Equal(t, 5, stats["totalDocsExamined"])
+	assert.Equal(t, 5, stats["nReturned"])
+
+	// Writes keep the indexes current
+	_, err = mockDocDB.UpdateMany("users", Document{"age": 7}, Document{"$set": Document{"age": 1000}})
+	assert.NoError(t, err)
+	_, err = mockDocDB.DeleteMany("users", Document{"age": Document{"$lt": 5}})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("users", Document{"_id": 500, "age": 1000, "city": "Rome"})
+	assert.NoError(t, err)
+	results, err := mockDocDB.FindDocument("users", Document{"age": 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+	_, stats = explain(Document{"age": 1000})
+	assert.Equal(t, 3, stats["totalKeysExamined"])
+	count, err := mockDocDB.CountDocuments("users", Document{"age": Document{"$lt": 5}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestIndexedQueriesMatchCollectionScans(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	indexed := NewMockDocDB(mockConfig)
+	plain := NewMockDocDB(mockConfig)
+
+	docs := []interface{}{
+		Document{"_id": 1, "v": 1, "tags": []interface{}{"a", "b"}},
+		Document{"_id": 2, "v": int64(2), "tags": []interface{}{}},
+		Document{"_id": 3, "v": 2.5, "tags": "a"},
+		Document{"_id": 4, "v": "2", "tags": []interface{}{[]interface{}{"a"}}},
+		Document{"_id": 5, "v": nil},
+		Document{"_id": 6},
+		Document{"_id": 7, "v": []interface{}{0, 10}},
+		Document{"_id": 8, "v": Document{"x": 1}, "tags": []interface{}{nil}},
+		Document{"_id": 9, "a": []interface{}{Document{"b": 1}, Document{"b": 2}}},
+		Document{"_id": 10, "a": []interface{}{Document{"b": 1.5}}},
+		Document{"_id": 11, "a": Document{"b": 3}},
+	}
+	for _, db := range []*MockDocDB{indexed, plain} {
+		_, err := db.InsertMany("values", docs)
+		assert.NoError(t, err)
+	}
+	for _, keys := range []bson.D{{{Key: "v", Value: 1}}, {{Key: "tags", Value: -1}}, {{Key: "tags", Value: 1}, {Key: "v", Value: 1}}, {{Key: "a.b", Value: 1}}} {
+		_, err := indexed.CreateIndex("values", mongo.IndexModel{Keys: keys})
+		assert.NoError(t, err)
+	}
+
+	filters := []Document{
+		{"v": 2},
+		{"v": nil},
+		{"v": Document{"$gt": 1, "$lt": 3}},
+		{"v": Document{"$gt": 5, "$lt": 1}},
+		{"v": Document{"$gte": 2}},
+		{"v": Document{"$lte": "2"}},
+		{"v": Document{"$in": []interface{}{1, "2", nil}}},
+		{"v": Document{"x": 1}},
+		{"v": Document{"$eq": 10}},
+		{"tags": "a"},
+		{"tags": nil},
+		{"tags": []interface{}{"a"}},
+		{"tags": Document{"$in": []interface{}{"b", nil}}},
+		{"tags": "a", "v": Document{"$gte": 1}},
+		// Each bound may be met by a different element of a
+		{"a.b": Document{"$gt": 1, "$lt": 2}},
+		{"a.b": Document{"$gte": 2, "$lte": 3}},
+	}
+	for _, filter := range filters {
+		expected, err := plain.FindDocument("values", filter)
+		assert.NoError(t, err)
+		actual, err := indexed.FindDocument("values", filter)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "filter %v", filter)
+	}
+
+	// The leading $match of a pipeline uses the same indexes
+	pipeline := []bson.M{{"$match": bson.M{"a.b": bson.M{"$gt": 1, "$lt": 2}}}, {"$project": bson.M{"_id": 1}}}
+	assert.Equal(t, aggregate(t, plain, "values", pipeline), aggregate(t, indexed, "values", pipeline))
+	assert.Len(t, aggregate(t, indexed, "values", pipeline), 2)
+}
+
+func TestIndexesStayConsistentAcrossWrites(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	indexed := NewMockDocDB(mockConfig)
+	plain := NewMockDocDB(mockConfig)
+
+	_, err := indexed.CreateIndex("items", mongo.IndexModel{Keys: bson.D{{Key: "v", Value: 1}}})
+	assert.NoError(t, err)
+	_, err = indexed.CreateIndex("items", mongo.IndexModel{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)})
+	assert.NoError(t, err)
+
+	// Enough writes to merge the pending and removed index entries several
+	// times, with queries in between seeing the unmerged ones
+	check := func(filter Document) {
+		expected, err := plain.FindDocument("items", filter)
+		assert.NoError(t, err)
+		actual, err := indexed.FindDocument("items", filter)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "filter %v", filter)
+	}
+	for i := 0; i < 600; i++ {
+		for _, db := range []*MockDocDB{indexed, plain} {
+			_, err := db.InsertDocument("items", Document{"_id": i, "v": i % 7, "code": i})
+			assert.NoError(t, err)
+			switch i % 5 {
+			case 1:
+				_, err = db.DeleteMany("items", Document{"_id": i - 1})
+			case 2:
+				_, err = db.UpdateOne("items", Document{"_id": i / 2}, Document{"$set": Document{"v": i % 11, "code": -i}})
+			case 3:
+				_, err = db.UpdateMany("items", Document{"v": i % 7}, Document{"$inc": Document{"n": 1}})
+			case 4:
+				_, err = db.DeleteMany("items", Document{"v": 3, "_id": Document{"$gt": i - 20}})
+			}
+			assert.NoError(t, err)
+		}
+		if i%97 == 0 {
+			check(Document{"v": i % 7})
+			check(Document{"code": Document{"$lt": 0}})
+		}
+	}
+	for v := 0; v < 11; v++ {
+		check(Document{"v": v})
+	}
+	check(Document{"v": Document{"$gte": 2, "$lt": 5}})
+	check(Document{"code": Document{"$gt": 300}})
+
+	// Keys freed by updates and deletes can be reused, and taken ones cannot
+	docs, err := indexed.FindDocument("items", Document{"code": Document{"$lt": 0}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, docs)
+	_, err = indexed.InsertDocument("items", Document{"_id": "reused", "code": docs[0]["_id"]})
+	assert.NoError(t, err)
+	_, err = indexed.InsertDocument("items", Document{"_id": "taken", "code": docs[0]["code"]})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+}
+
+func TestReturnedDocumentsAreCopies(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.CreateIndex("items", mongo.IndexModel{Keys: bson.D{{Key: "v", Value: 1}}})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("items", Document{"_id": "x", "v": "a", "tags": []interface{}{"a"}})
+	assert.NoError(t, err)
+
+	// Changing what a query returned must not reach the stored document or
+	// leave the index pointing at a value the document no longer has
+	docs, err := mockDocDB.FindDocument("items", Document{"v": "a"})
+	assert.NoError(t, err)
+	assert.Len(t, docs, 1)
+	docs[0]["v"] = "b"
+	docs[0]["tags"].([]interface{})[0] = "b"
+
+	docs, err = mockDocDB.FindDocument("items", Document{"v": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{{"_id": "x", "v": "a", "tags": []interface{}{"a"}}}, docs)
+	docs, err = mockDocDB.FindDocument("items", Document{"v": "b"})
+	assert.NoError(t, err)
+	assert.Empty(t, docs)
+}
+
+func TestTTLIndexes(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewMockClock(start)
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false, Clock: clock}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	name, err := mockDocDB.CreateIndex("sessions", mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(3600),
+	})
+	assert.NoError(t, err)
+	specs, err := mockDocDB.ListIndexes("sessions")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3600), specs[1]["expireAfterSeconds"])
+	_, err = mockDocDB.CreateIndex("sessions", mongo.IndexModel{
+		Keys:    bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(60),
+	})
+	assert.Error(t, err)
+
+	_, err = mockDocDB.InsertMany("sessions", []interface{}{
+		Document{"_id": "old", "createdAt": start.Add(-30 * time.Minute)},
+		Document{"_id": "new", "createdAt": primitive.NewDateTimeFromTime(start)},
+		Document{"_id": "array", "createdAt": []interface{}{start.Add(time.Hour), start.Add(-10 * time.Minute)}},
+		Document{"_id": "string", "createdAt": "2020-01-01"},
+		Document{"_id": "missing"},
+	})
+	assert.NoError(t, err)
+
+	// The session created at the clock's time gets $currentDate from it too
+	_, err = mockDocDB.UpdateOne("sessions", Document{"_id": "new"}, Document{"$currentDate": Document{"seenAt": true}})
+	assert.NoError(t, err)
+	results, err := mockDocDB.FindDocument("sessions", Document{"_id": "new"})
+	assert.NoError(t, err)
+	assert.Equal(t, start, results[0]["seenAt"])
+
+	reaped, err := mockDocDB.ReapExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, reaped)
+
+	clock.Advance(30 * time.Minute)
+	reaped, err = mockDocDB.ReapExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+
+	clock.Advance(time.Hour)
+	reaped, err = mockDocDB.ReapExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reaped)
+
+	results, err = mockDocDB.FindDocument("sessions", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	count, err := mockDocDB.CountDocuments("sessions", Document{"createdAt": Document{"$exists": true}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// The background monitor reaps without being asked
+	_, err = mockDocDB.InsertDocument("sessions", Document{"_id": "late", "createdAt": clock.Now()})
+	assert.NoError(t, err)
+	clock.Advance(2 * time.Hour)
+	stop := mockDocDB.StartTTLMonitor(5 * time.Millisecond)
+	defer stop()
+	assert.Eventually(t, func() bool {
+		count, err := mockDocDB.CountDocuments("sessions", Document{"_id": "late"})
+		return err == nil && count == 0
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, mockDocDB.DropIndex("sessions", name))
+}
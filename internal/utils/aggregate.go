@@ -0,0 +1,430 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// computedField is an output field of $project or $addFields whose value
+// comes from an expression.
+type computedField struct {
+	path string
+	expr interface{}
+}
+
+// flattenFields calls visit for every field of spec, with embedded documents
+// that are not expressions turned into dotted paths, so {"a": {"b": 1}}
+// visits "a.b".
+func flattenFields(spec map[string]interface{}, prefix string, visit func(path string, value interface{}) error) error {
+	for _, key := range sortedKeys(spec) {
+		value := spec[key]
+		if key == "" || strings.HasPrefix(key, "$") {
+			return fmt.Errorf("field names may not be empty or start with '$': %s", key)
+		}
+		path := prefix + key
+		if nested, ok := AsDocument(value); ok && len(nested) > 0 {
+			if _, _, isOperator, err := singleOperator(nested); err != nil {
+				return err
+			} else if !isOperator {
+				if err := flattenFields(nested, path+".", visit); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := visit(path, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProjectStage is a parsed $project stage. Fields set to 1 or true are kept
+// and fields set to 0 or false removed, as in a find projection, and any
+// other value is an expression computing a new field, which makes the stage
+// an inclusion.
+type ProjectStage struct {
+	projection *Projection
+	computed   []computedField
+}
+
+// ParseProjectStage validates the specification of a $project stage.
+func ParseProjectStage(spec interface{}) (*ProjectStage, error) {
+	fields, ok := AsDocument(spec)
+	if !ok {
+		return nil, errors.New("$project specification must be an object")
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("$project requires at least one output field")
+	}
+	flags := make(map[string]interface{})
+	var computed []computedField
+	paths := &projectionNode{children: map[string]*projectionNode{}}
+	excluded := ""
+	err := flattenFields(fields, "", func(path string, value interface{}) error {
+		if err := paths.add(path); err != nil {
+			return fmt.Errorf("invalid $project :: %w", err)
+		}
+		if include, ok := projectionFlag(value); ok {
+			flags[path] = value
+			if !include && path != "_id" {
+				excluded = path
+			}
+			return nil
+		}
+		computed = append(computed, computedField{path: path, expr: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if excluded != "" && len(computed) > 0 {
+		return nil, fmt.Errorf("invalid $project :: cannot do exclusion on field %s in inclusion projection", excluded)
+	}
+	projection, err := ParseProjection(flags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $project :: %w", err)
+	}
+	if len(computed) > 0 {
+		projection.inclusion = true
+	}
+	return &ProjectStage{projection: projection, computed: computed}, nil
+}
+
+// Apply returns the projected copy of doc.
+func (s *ProjectStage) Apply(doc Document, vars Variables) (Document, error) {
+	result, err := s.projection.Apply(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := setComputed(result, s.computed, doc, vars); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// AddFieldsStage is a parsed $addFields or $set stage.
+type AddFieldsStage struct {
+	computed []computedField
+}
+
+// ParseAddFieldsStage validates the specification of an $addFields or $set
+// stage, in which every field is an expression.
+func ParseAddFieldsStage(spec interface{}) (*AddFieldsStage, error) {
+	fields, ok := AsDocument(spec)
+	if !ok {
+		return nil, errors.New("$addFields specification must be an object")
+	}
+	stage := &AddFieldsStage{}
+	err := flattenFields(fields, "", func(path string, value interface{}) error {
+		stage.computed = append(stage.computed, computedField{path: path, expr: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stage, nil
+}
+
+// Apply returns a copy of doc with the fields set. A field whose expression
+// has no value, such as $$REMOVE, is removed instead.
+func (s *AddFieldsStage) Apply(doc Document, vars Variables) (Document, error) {
+	result := Document(CopyValue(map[string]interface{}(doc)).(map[string]interface{}))
+	if err := setComputed(result, s.computed, doc, vars); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// setComputed evaluates every field against doc before storing any of
+// them in result, so fields cannot see each other's new values.
+func setComputed(result Document, computed []computedField, doc Document, vars Variables) error {
+	values := make([]interface{}, len(computed))
+	exists := make([]bool, len(computed))
+	for i, field := range computed {
+		var err error
+		if values[i], exists[i], err = EvaluateExpression(field.expr, doc, vars); err != nil {
+			return err
+		}
+	}
+	for i, field := range computed {
+		if !exists[i] {
+			UnsetPath(result, field.path)
+			continue
+		}
+		if err := SetPath(result, field.path, CopyValue(values[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseUnsetStage converts the field name, or array of field names, of an
+// $unset stage into the exclusion projection it stands for.
+func ParseUnsetStage(spec interface{}) (*Projection, error) {
+	names, ok := AsArray(spec)
+	if !ok {
+		names = []interface{}{spec}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("$unset specification must be a string or an array with at least one field")
+	}
+	fields := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		path, ok := name.(string)
+		if !ok || path == "" {
+			return nil, errors.New("$unset specification must be a string or an array containing only strings")
+		}
+		fields[path] = 0
+	}
+	return ParseProjection(fields)
+}
+
+// UnwindStage is a parsed $unwind stage.
+type UnwindStage struct {
+	path              string
+	includeArrayIndex string
+	preserve          bool
+}
+
+// ParseUnwindStage validates an $unwind stage, given as a field path such
+// as "$items" or as a document with path, includeArrayIndex and
+// preserveNullAndEmptyArrays.
+func ParseUnwindStage(spec interface{}) (*UnwindStage, error) {
+	stage := &UnwindStage{}
+	var path interface{} = spec
+	if options, ok := AsDocument(spec); ok {
+		for key, value := range options {
+			switch key {
+			case "path":
+				path = value
+			case "includeArrayIndex":
+				name, ok := value.(string)
+				if !ok || name == "" || strings.HasPrefix(name, "$") {
+					return nil, errors.New("includeArrayIndex option to $unwind stage must be a non-empty string that does not start with '$'")
+				}
+				stage.includeArrayIndex = name
+			case "preserveNullAndEmptyArrays":
+				preserve, ok := value.(bool)
+				if !ok {
+					return nil, errors.New("expected a boolean for the preserveNullAndEmptyArrays option to $unwind stage")
+				}
+				stage.preserve = preserve
+			default:
+				return nil, fmt.Errorf("unrecognized option to $unwind stage: %s", key)
+			}
+		}
+		if _, ok := options["path"]; !ok {
+			return nil, errors.New("no path specified to $unwind stage")
+		}
+	}
+	name, ok := path.(string)
+	if !ok || len(name) < 2 || !strings.HasPrefix(name, "$") || strings.HasPrefix(name, "$$") {
+		return nil, fmt.Errorf("path option to $unwind stage should be prefixed with a '$': %v", path)
+	}
+	stage.path = name[1:]
+	return stage, nil
+}
+
+// Apply returns one copy of doc per element of the array at the stage's
+// path, with the path set to the element. A value that is not an array
+// counts as a single element. Documents where the path is missing, null or
+// an empty array are dropped unless preserveNullAndEmptyArrays is set.
+func (s *UnwindStage) Apply(doc Document) ([]Document, error) {
+	value, exists := LookupPath(doc, s.path)
+	elements, isArray := AsArray(value)
+	if !isArray || len(elements) == 0 {
+		if !s.preserve && (!exists || isNull(value) || isArray) {
+			return nil, nil
+		}
+		result := Document(CopyValue(map[string]interface{}(doc)).(map[string]interface{}))
+		if s.includeArrayIndex != "" {
+			if err := SetPath(result, s.includeArrayIndex, nil); err != nil {
+				return nil, err
+			}
+		}
+		return []Document{result}, nil
+	}
+	results := make([]Document, 0, len(elements))
+	for i, elem := range elements {
+		result := Document(CopyValue(map[string]interface{}(doc)).(map[string]interface{}))
+		if err := SetPath(result, s.path, CopyValue(elem)); err != nil {
+			return nil, err
+		}
+		if s.includeArrayIndex != "" {
+			if err := SetPath(result, s.includeArrayIndex, int64(i)); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ReplaceRoot evaluates the newRoot expression of a $replaceRoot or
+// $replaceWith stage against doc, which must give a document.
+func ReplaceRoot(doc Document, newRoot interface{}, vars Variables) (Document, error) {
+	value, _, err := EvaluateExpression(newRoot, doc, vars)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := AsDocument(value)
+	if !ok {
+		return nil, fmt.Errorf("'newRoot' expression must evaluate to an object, but resulting value was of type %s", BSONType(value))
+	}
+	return Document(CopyValue(root).(map[string]interface{})), nil
+}
+
+// ParseSkipOrLimit validates the argument of a $skip or $limit stage: a
+// non-negative integer, which for $limit must also be positive.
+func ParseSkipOrLimit(stage string, spec interface{}) (int, error) {
+	n, ok := toFloat(spec)
+	if !ok || n != float64(int(n)) || n < 0 || (stage == "$limit" && n == 0) {
+		return 0, fmt.Errorf("invalid argument to %s stage: %v", stage, spec)
+	}
+	return int(n), nil
+}
+
+// LookupStage is a parsed $lookup stage, which joins each document with the
+// matching documents of another collection: those whose foreignField equals
+// the document's localField, those produced by a sub-pipeline, which may use
+// let variables computed from the document, or those passing both.
+type LookupStage struct {
+	from         string
+	as           string
+	localField   string
+	foreignField string
+	let          map[string]interface{}
+	pipeline     []interface{}
+}
+
+// ParseLookupStage validates the specification of a $lookup stage.
+func ParseLookupStage(spec interface{}) (*LookupStage, error) {
+	fields, ok := AsDocument(spec)
+	if !ok {
+		return nil, errors.New("the $lookup specification must be an object")
+	}
+	stage := &LookupStage{}
+	for key, value := range fields {
+		switch key {
+		case "from", "as", "localField", "foreignField":
+			s, ok := value.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("$lookup argument '%s' must be a non-empty string", key)
+			}
+			switch key {
+			case "from":
+				stage.from = s
+			case "as":
+				stage.as = s
+			case "localField":
+				stage.localField = s
+			default:
+				stage.foreignField = s
+			}
+		case "let":
+			let, ok := AsDocument(value)
+			if !ok {
+				return nil, errors.New("$lookup argument 'let' must be an object")
+			}
+			for name := range let {
+				if !validVariableName(name) {
+					return nil, fmt.Errorf("'%s' is not a valid variable name: it must start with a lowercase letter and contain only letters, digits and '_'", name)
+				}
+			}
+			stage.let = let
+		case "pipeline":
+			pipeline, ok := AsArray(value)
+			if !ok {
+				return nil, errors.New("$lookup argument 'pipeline' must be an array")
+			}
+			stage.pipeline = pipeline
+		default:
+			return nil, fmt.Errorf("unknown argument to $lookup: %s", key)
+		}
+	}
+	switch {
+	case stage.from == "":
+		return nil, errors.New("missing 'from' option to $lookup stage specification")
+	case stage.as == "":
+		return nil, errors.New("must specify 'as' field for a $lookup")
+	case (stage.localField == "") != (stage.foreignField == ""):
+		return nil, errors.New("$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	case stage.localField == "" && stage.pipeline == nil:
+		return nil, errors.New("$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	}
+	return stage, nil
+}
+
+func validVariableName(name string) bool {
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// From returns the name of the collection the stage joins with.
+func (s *LookupStage) From() string {
+	return s.from
+}
+
+// Pipeline returns the pipeline that finds the documents joined with doc,
+// and the variables to run it with: vars plus the let variables evaluated
+// against doc. With localField and foreignField, the pipeline starts with a
+// $match on foreignField being any of the values at localField, where an
+// array contributes each of its elements and a missing field counts as null.
+func (s *LookupStage) Pipeline(doc Document, vars Variables) ([]interface{}, Variables, error) {
+	var pipeline []interface{}
+	if s.localField != "" {
+		var values []interface{}
+		for _, value := range ResolvePath(doc, s.localField) {
+			if elements, ok := AsArray(value); ok {
+				values = append(values, elements...)
+			} else {
+				values = append(values, value)
+			}
+		}
+		if values == nil {
+			values = []interface{}{nil}
+		}
+		pipeline = append(pipeline, map[string]interface{}{
+			"$match": map[string]interface{}{s.foreignField: map[string]interface{}{"$in": values}},
+		})
+	}
+	pipeline = append(pipeline, s.pipeline...)
+	if len(s.let) == 0 {
+		return pipeline, vars, nil
+	}
+	joinVars := make(Variables, len(vars)+len(s.let))
+	for name, value := range vars {
+		joinVars[name] = value
+	}
+	for name, expr := range s.let {
+		value, _, err := EvaluateExpression(expr, doc, vars)
+		if err != nil {
+			return nil, nil, err
+		}
+		joinVars[name] = value
+	}
+	return pipeline, joinVars, nil
+}
+
+// Join returns a copy of doc with the joined documents stored as an array
+// at the stage's as field.
+func (s *LookupStage) Join(doc Document, joined []Document) (Document, error) {
+	values := make([]interface{}, len(joined))
+	for i, match := range joined {
+		values[i] = CopyValue(map[string]interface{}(match))
+	}
+	result := Document(CopyValue(map[string]interface{}(doc)).(map[string]interface{}))
+	if err := SetPath(result, s.as, values); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"math/big"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// IsNumber reports whether v is a numeric BSON value.
+func IsNumber(v interface{}) bool {
+	return isNumberType(BSONType(v))
+}
+
+// integer widths, ordered so the wider of two operands wins.
+const (
+	widthInt32 = iota
+	widthInt
+	widthInt64
+)
+
+func integerWidth(v interface{}) int {
+	switch v.(type) {
+	case int8, int16, int32, uint8, uint16:
+		return widthInt32
+	case int:
+		return widthInt
+	}
+	return widthInt64
+}
+
+// addNumbers adds two numbers with DocumentDB's widening rules: decimals win
+// over doubles, doubles over integers, and integers keep the wider of the two
+// operand types, growing to int64 when the sum no longer fits.
+func addNumbers(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b, new(big.Float).Add, func(x, y int64) (int64, bool) {
+		sum := x + y
+		return sum, (sum > x) == (y > 0)
+	}, func(x, y float64) float64 { return x + y })
+}
+
+// multiplyNumbers multiplies two numbers with the same widening rules as
+// addNumbers.
+func multiplyNumbers(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b, new(big.Float).Mul, func(x, y int64) (int64, bool) {
+		if x == 0 || y == 0 {
+			return 0, true
+		}
+		product := x * y
+		return product, product/y == x && !(x == -1 && y == math.MinInt64) && !(y == -1 && x == math.MinInt64)
+	}, func(x, y float64) float64 { return x * y })
+}
+
+func arithmetic(a, b interface{},
+	decimalOp func(x, y *big.Float) *big.Float,
+	intOp func(x, y int64) (int64, bool),
+	floatOp func(x, y float64) float64) (interface{}, error) {
+	if !IsNumber(a) || !IsNumber(b) {
+		return nil, errors.New("arithmetic requires numeric operands")
+	}
+	_, decimalA := a.(primitive.Decimal128)
+	_, decimalB := b.(primitive.Decimal128)
+	if decimalA || decimalB {
+		x, nanA := bigNumber(a)
+		y, nanB := bigNumber(b)
+		if nanA || nanB {
+			return primitive.NewDecimal128(0x7c00000000000000, 0), nil
+		}
+		return primitive.ParseDecimal128(decimalOp(x, y).Text('g', 34))
+	}
+	x, intA := toInt64(a)
+	y, intB := toInt64(b)
+	if !intA || !intB {
+		return floatOp(numberFloat(a), numberFloat(b)), nil
+	}
+	result, ok := intOp(x, y)
+	if !ok {
+		return nil, errors.New("integer overflow")
+	}
+	width := integerWidth(a)
+	if w := integerWidth(b); w > width {
+		width = w
+	}
+	switch {
+	case width == widthInt32 && result >= math.MinInt32 && result <= math.MaxInt32:
+		return int32(result), nil
+	case width <= widthInt && result >= math.MinInt && result <= math.MaxInt:
+		return int(result), nil
+	}
+	return result, nil
+}
+
+// zeroLike returns a zero of the same numeric type as v.
+func zeroLike(v interface{}) interface{} {
+	result, _ := multiplyNumbers(v, int32(0))
+	return result
+}
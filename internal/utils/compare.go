@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typeOrder ranks BSON types in the order DocumentDB sorts and compares
+// values of different types. Numbers share one rank, as do strings and
+// symbols, so values within a rank compare by content.
+var typeOrder = map[string]int{
+	"minKey":              0,
+	"null":                1,
+	"undefined":           1,
+	"double":              2,
+	"int":                 2,
+	"long":                2,
+	"decimal":             2,
+	"string":              3,
+	"symbol":              3,
+	"object":              4,
+	"array":               5,
+	"binData":             6,
+	"objectId":            7,
+	"bool":                8,
+	"date":                9,
+	"timestamp":           10,
+	"regex":               11,
+	"dbPointer":           12,
+	"javascript":          12,
+	"javascriptWithScope": 12,
+	"maxKey":              13,
+}
+
+// TypeRank returns the position of v's type in the BSON comparison order.
+func TypeRank(v interface{}) int {
+	return typeOrder[BSONType(v)]
+}
+
+// CompareValues orders two values the way DocumentDB does: first by type
+// (null < numbers < strings < objects < arrays < binary < ObjectId < bool <
+// dates < timestamps < regexes), then by content. Numbers of any Go type
+// compare by value, so int(1), int64(1) and 1.0 are equal.
+func CompareValues(a, b interface{}) int {
+	rankA, rankB := TypeRank(a), TypeRank(b)
+	if rankA != rankB {
+		return compareInts(rankA, rankB)
+	}
+	switch BSONType(a) {
+	case "null", "undefined", "minKey", "maxKey":
+		return 0
+	case "double", "int", "long", "decimal":
+		return compareNumbers(a, b)
+	case "string", "symbol":
+		return strings.Compare(stringValue(a), stringValue(b))
+	case "object":
+		return compareDocuments(a, b)
+	case "array":
+		return compareArrays(a, b)
+	case "binData":
+		return compareBinary(a, b)
+	case "objectId":
+		idA, idB := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(idA[:], idB[:])
+	case "bool":
+		return compareInts(boolInt(a.(bool)), boolInt(b.(bool)))
+	case "date":
+		return compareTimes(timeValue(a), timeValue(b))
+	case "timestamp":
+		tsA, tsB := a.(primitive.Timestamp), b.(primitive.Timestamp)
+		return primitive.CompareTimestamp(tsA, tsB)
+	case "regex":
+		patternA, optionsA := regexParts(a)
+		patternB, optionsB := regexParts(b)
+		if c := strings.Compare(patternA, patternB); c != 0 {
+			return c
+		}
+		return strings.Compare(optionsA, optionsB)
+	}
+	return 0
+}
+
+// EqualValues reports whether two values are equal under CompareValues.
+func EqualValues(a, b interface{}) bool {
+	return CompareValues(a, b) == 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// compareNumbers compares integers exactly, falls back to float64 for mixed
+// integer and floating point values and to arbitrary precision when either
+// side is a decimal. NaN sorts before every other number.
+func compareNumbers(a, b interface{}) int {
+	intA, okA := toInt64(a)
+	intB, okB := toInt64(b)
+	if okA && okB {
+		switch {
+		case intA < intB:
+			return -1
+		case intA > intB:
+			return 1
+		}
+		return 0
+	}
+	// Doubles compare as floats, but an integer is compared with a double
+	// exactly, since converting an int64 to float64 may round it.
+	if _, isDecimal := a.(primitive.Decimal128); !isDecimal && !okA && !okB {
+		if _, isDecimal = b.(primitive.Decimal128); !isDecimal {
+			return compareFloats(numberFloat(a), numberFloat(b))
+		}
+	}
+	bigA, nanA := bigNumber(a)
+	bigB, nanB := bigNumber(b)
+	switch {
+	case nanA && nanB:
+		return 0
+	case nanA:
+		return -1
+	case nanB:
+		return 1
+	}
+	return bigA.Cmp(bigB)
+}
+
+func compareFloats(a, b float64) int {
+	nanA, nanB := math.IsNaN(a), math.IsNaN(b)
+	switch {
+	case nanA && nanB:
+		return 0
+	case nanA:
+		return -1
+	case nanB:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// toInt64 converts Go integer types to int64. Unsigned values too large for
+// an int64 are reported as not convertible so they compare as floats.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint:
+		if uint64(n) <= math.MaxInt64 {
+			return int64(n), true
+		}
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// numberFloat converts any numeric value, including decimals, to a float64.
+func numberFloat(v interface{}) float64 {
+	if f, ok := toFloat(v); ok {
+		return f
+	}
+	if _, ok := v.(primitive.Decimal128); ok {
+		f, isNaN := bigNumber(v)
+		if isNaN {
+			return math.NaN()
+		}
+		value, _ := f.Float64()
+		return value
+	}
+	return 0
+}
+
+func bigNumber(v interface{}) (*big.Float, bool) {
+	if d, ok := v.(primitive.Decimal128); ok {
+		f, _, err := big.ParseFloat(d.String(), 10, 128, big.ToNearestEven)
+		if err != nil {
+			// NaN and the infinities do not parse.
+			switch d.String() {
+			case "Infinity":
+				return new(big.Float).SetInf(false), false
+			case "-Infinity":
+				return new(big.Float).SetInf(true), false
+			}
+			return nil, true
+		}
+		return f, false
+	}
+	if i, ok := toInt64(v); ok {
+		return new(big.Float).SetInt64(i), false
+	}
+	f := numberFloat(v)
+	if math.IsNaN(f) {
+		return nil, true
+	}
+	return big.NewFloat(f), false
+}
+
+func stringValue(v interface{}) string {
+	if s, ok := v.(primitive.Symbol); ok {
+		return string(s)
+	}
+	return v.(string)
+}
+
+// compareDocuments compares embedded documents field by field. Go maps carry
+// no field order, so fields are visited in sorted name order.
+func compareDocuments(a, b interface{}) int {
+	docA, _ := AsDocument(a)
+	docB, _ := AsDocument(b)
+	keysA, keysB := sortedKeys(docA), sortedKeys(docB)
+	for i := 0; i < len(keysA) && i < len(keysB); i++ {
+		if c := strings.Compare(keysA[i], keysB[i]); c != 0 {
+			return c
+		}
+		if c := CompareValues(docA[keysA[i]], docB[keysB[i]]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(keysA), len(keysB))
+}
+
+func sortedKeys(d map[string]interface{}) []string {
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func compareArrays(a, b interface{}) int {
+	arrA, _ := AsArray(a)
+	arrB, _ := AsArray(b)
+	for i := 0; i < len(arrA) && i < len(arrB); i++ {
+		if c := CompareValues(arrA[i], arrB[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(arrA), len(arrB))
+}
+
+func compareBinary(a, b interface{}) int {
+	subtypeA, dataA := binaryParts(a)
+	subtypeB, dataB := binaryParts(b)
+	if c := compareInts(len(dataA), len(dataB)); c != 0 {
+		return c
+	}
+	if c := compareInts(int(subtypeA), int(subtypeB)); c != 0 {
+		return c
+	}
+	return bytes.Compare(dataA, dataB)
+}
+
+func binaryParts(v interface{}) (byte, []byte) {
+	if bin, ok := v.(primitive.Binary); ok {
+		return bin.Subtype, bin.Data
+	}
+	return 0, v.([]byte)
+}
+
+func timeValue(v interface{}) time.Time {
+	if dt, ok := v.(primitive.DateTime); ok {
+		return dt.Time()
+	}
+	return v.(time.Time)
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func regexParts(v interface{}) (string, string) {
+	switch r := v.(type) {
+	case primitive.Regex:
+		return r.Pattern, r.Options
+	case *regexp.Regexp:
+		return r.String(), ""
+	}
+	return "", ""
+}
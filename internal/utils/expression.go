@@ -0,0 +1,585 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Variables holds the values that $$name references in an expression
+// resolve to, such as the let variables of a $lookup.
+type Variables map[string]interface{}
+
+// EvaluateExpression evaluates an aggregation expression against doc: "$a.b"
+// is a field path, "$$name" a variable, with $$ROOT and $$CURRENT standing
+// for doc, a document with a single "$" key is an operator such as
+// {"$add": ["$price", 1]}, other documents and arrays are evaluated
+// element by element, and anything else is a literal. It also reports
+// whether the value exists: a path to a missing field, and $$REMOVE, have
+// no value, which stages take as leaving the field out.
+func EvaluateExpression(expr interface{}, doc Document, vars Variables) (interface{}, bool, error) {
+	return (&evaluation{root: doc, vars: vars}).eval(expr)
+}
+
+type evaluation struct {
+	root Document
+	vars Variables
+}
+
+func (e *evaluation) eval(expr interface{}) (interface{}, bool, error) {
+	if s, ok := expr.(string); ok && strings.HasPrefix(s, "$") {
+		return e.reference(s)
+	}
+	if d, ok := AsDocument(expr); ok {
+		if operator, operand, ok, err := singleOperator(d); err != nil {
+			return nil, false, err
+		} else if ok {
+			value, err := e.operator(operator, operand)
+			if err != nil {
+				return nil, false, err
+			}
+			if _, isMissing := value.(missingValue); isMissing {
+				return nil, false, nil
+			}
+			return value, true, nil
+		}
+		result := make(map[string]interface{}, len(d))
+		for key, value := range d {
+			evaluated, exists, err := e.eval(value)
+			if err != nil {
+				return nil, false, err
+			}
+			if exists {
+				result[key] = evaluated
+			}
+		}
+		return result, true, nil
+	}
+	if elements, ok := AsArray(expr); ok {
+		result := make([]interface{}, len(elements))
+		for i, elem := range elements {
+			value, _, err := e.eval(elem)
+			if err != nil {
+				return nil, false, err
+			}
+			result[i] = value
+		}
+		return result, true, nil
+	}
+	return expr, true, nil
+}
+
+// missingValue is returned by operators whose result has no value, like
+// $arrayElemAt past the end of an array.
+type missingValue struct{}
+
+// singleOperator reports whether d is an operator expression. Mixing
+// operators with plain fields is an error.
+func singleOperator(d map[string]interface{}) (string, interface{}, bool, error) {
+	for key, value := range d {
+		if !strings.HasPrefix(key, "$") {
+			continue
+		}
+		if len(d) != 1 {
+			return "", nil, false, fmt.Errorf("an expression specification must contain exactly one field, the name of the expression: %s", key)
+		}
+		return key, value, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// reference resolves a field path or a variable.
+func (e *evaluation) reference(s string) (interface{}, bool, error) {
+	if !strings.HasPrefix(s, "$$") {
+		if len(s) == 1 {
+			return nil, false, errors.New("'$' by itself is not a valid FieldPath")
+		}
+		return fieldPath(map[string]interface{}(e.root), strings.Split(s[1:], "."))
+	}
+	segments := strings.Split(s[2:], ".")
+	var value interface{}
+	switch name := segments[0]; name {
+	case "ROOT", "CURRENT":
+		value = map[string]interface{}(e.root)
+	case "REMOVE":
+		return nil, false, nil
+	default:
+		v, ok := e.vars[name]
+		if !ok {
+			return nil, false, fmt.Errorf("use of undefined variable: %s", name)
+		}
+		value = v
+	}
+	if len(segments) == 1 {
+		return value, true, nil
+	}
+	return fieldPath(value, segments[1:])
+}
+
+// fieldPath follows segments from node. Arrays are mapped over, so "$a.b"
+// on an array of documents yields the array of their b values, leaving out
+// elements without one.
+func fieldPath(node interface{}, segments []string) (interface{}, bool, error) {
+	if len(segments) == 0 {
+		return node, true, nil
+	}
+	if d, ok := AsDocument(node); ok {
+		child, exists := d[segments[0]]
+		if !exists {
+			return nil, false, nil
+		}
+		return fieldPath(child, segments[1:])
+	}
+	if elements, ok := AsArray(node); ok {
+		result := []interface{}{}
+		for _, elem := range elements {
+			_, isDoc := AsDocument(elem)
+			_, isArray := AsArray(elem)
+			if !isDoc && !isArray {
+				continue
+			}
+			if value, exists, _ := fieldPath(elem, segments); exists {
+				result = append(result, value)
+			}
+		}
+		return result, true, nil
+	}
+	return nil, false, nil
+}
+
+// operator evaluates an operator expression. Most operators take their
+// evaluated arguments, with missing values passed as null; $literal, $cond,
+// $ifNull, $and and $or evaluate their arguments themselves.
+func (e *evaluation) operator(operator string, operand interface{}) (interface{}, error) {
+	switch operator {
+	case "$literal":
+		return operand, nil
+	case "$cond":
+		return e.cond(operand)
+	case "$ifNull":
+		return e.ifNull(operand)
+	case "$and", "$or":
+		return e.logical(operator, operand)
+	}
+	fn, ok := expressionOperators[operator]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized expression '%s'", operator)
+	}
+	args, err := e.args(operand)
+	if err != nil {
+		return nil, err
+	}
+	return fn(operator, args)
+}
+
+// args evaluates the arguments of an operator, which are given as an array
+// or, for a single argument, on their own.
+func (e *evaluation) args(operand interface{}) ([]interface{}, error) {
+	elements, ok := AsArray(operand)
+	if !ok {
+		elements = []interface{}{operand}
+	}
+	args := make([]interface{}, len(elements))
+	for i, elem := range elements {
+		value, _, err := e.eval(elem)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return args, nil
+}
+
+func (e *evaluation) cond(operand interface{}) (interface{}, error) {
+	var condition, then, otherwise interface{}
+	if d, ok := AsDocument(operand); ok {
+		for key := range d {
+			if key != "if" && key != "then" && key != "else" {
+				return nil, fmt.Errorf("unrecognized parameter to $cond: %s", key)
+			}
+		}
+		if len(d) != 3 {
+			return nil, errors.New("$cond requires if, then and else")
+		}
+		condition, then, otherwise = d["if"], d["then"], d["else"]
+	} else if elements, ok := AsArray(operand); ok && len(elements) == 3 {
+		condition, then, otherwise = elements[0], elements[1], elements[2]
+	} else {
+		return nil, errors.New("expression $cond takes exactly 3 arguments")
+	}
+	value, _, err := e.eval(condition)
+	if err != nil {
+		return nil, err
+	}
+	branch := otherwise
+	if truthy(value) {
+		branch = then
+	}
+	result, exists, err := e.eval(branch)
+	if !exists && err == nil {
+		return missingValue{}, nil
+	}
+	return result, err
+}
+
+func (e *evaluation) ifNull(operand interface{}) (interface{}, error) {
+	elements, ok := AsArray(operand)
+	if !ok || len(elements) < 2 {
+		return nil, errors.New("$ifNull needs at least two arguments")
+	}
+	for i, elem := range elements {
+		value, exists, err := e.eval(elem)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(elements)-1 {
+			if !exists {
+				return missingValue{}, nil
+			}
+			return value, nil
+		}
+		if exists && !isNull(value) {
+			return value, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *evaluation) logical(operator string, operand interface{}) (interface{}, error) {
+	elements, ok := AsArray(operand)
+	if !ok {
+		elements = []interface{}{operand}
+	}
+	for _, elem := range elements {
+		value, _, err := e.eval(elem)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(value) == (operator == "$or") {
+			return operator == "$or", nil
+		}
+	}
+	return operator == "$and", nil
+}
+
+func isNull(v interface{}) bool {
+	switch v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return true
+	}
+	return false
+}
+
+var expressionOperators map[string]func(operator string, args []interface{}) (interface{}, error)
+
+func init() {
+	expressionOperators = map[string]func(string, []interface{}) (interface{}, error){
+		"$add":         addExpression,
+		"$subtract":    subtractExpression,
+		"$multiply":    multiplyExpression,
+		"$divide":      divideExpression,
+		"$mod":         modExpression,
+		"$abs":         absExpression,
+		"$eq":          comparisonExpression,
+		"$ne":          comparisonExpression,
+		"$gt":          comparisonExpression,
+		"$gte":         comparisonExpression,
+		"$lt":          comparisonExpression,
+		"$lte":         comparisonExpression,
+		"$cmp":         comparisonExpression,
+		"$not":         notExpression,
+		"$concat":      concatExpression,
+		"$toLower":     caseExpression,
+		"$toUpper":     caseExpression,
+		"$size":        sizeExpression,
+		"$arrayElemAt": arrayElemAtExpression,
+		"$in":          inExpression,
+		"$isArray":     isArrayExpression,
+	}
+}
+
+func argCount(operator string, args []interface{}, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("expression %s takes exactly %d arguments, %d were passed in", operator, n, len(args))
+	}
+	return nil
+}
+
+func anyNull(args []interface{}) bool {
+	for _, arg := range args {
+		if isNull(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDate(v interface{}) bool {
+	return BSONType(v) == "date"
+}
+
+// addExpression sums numbers with the update operators' widening rules. One
+// argument may be a date, to which the others are added as milliseconds.
+func addExpression(operator string, args []interface{}) (interface{}, error) {
+	if anyNull(args) {
+		return nil, nil
+	}
+	var sum interface{} = int32(0)
+	var date *time.Time
+	for _, arg := range args {
+		if isDate(arg) {
+			if date != nil {
+				return nil, errors.New("only one date allowed in an $add expression")
+			}
+			t := timeValue(arg)
+			date = &t
+			continue
+		}
+		if !IsNumber(arg) {
+			return nil, fmt.Errorf("$add only supports numeric or date types, not %s", BSONType(arg))
+		}
+		var err error
+		if sum, err = addNumbers(sum, arg); err != nil {
+			return nil, err
+		}
+	}
+	if date != nil {
+		return primitive.NewDateTimeFromTime(date.Add(time.Duration(math.Round(numberFloat(sum))) * time.Millisecond)), nil
+	}
+	return sum, nil
+}
+
+// subtractExpression subtracts numbers, a number of milliseconds from a
+// date, or two dates, which gives the milliseconds between them.
+func subtractExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 2); err != nil {
+		return nil, err
+	}
+	if anyNull(args) {
+		return nil, nil
+	}
+	a, b := args[0], args[1]
+	switch {
+	case isDate(a) && isDate(b):
+		return timeValue(a).Sub(timeValue(b)).Milliseconds(), nil
+	case isDate(a) && IsNumber(b):
+		return primitive.NewDateTimeFromTime(timeValue(a).Add(-time.Duration(math.Round(numberFloat(b))) * time.Millisecond)), nil
+	case IsNumber(a) && IsNumber(b):
+		negated, err := multiplyNumbers(b, int32(-1))
+		if err != nil {
+			return nil, err
+		}
+		return addNumbers(a, negated)
+	}
+	return nil, fmt.Errorf("can't $subtract %s from %s", BSONType(b), BSONType(a))
+}
+
+func multiplyExpression(operator string, args []interface{}) (interface{}, error) {
+	if anyNull(args) {
+		return nil, nil
+	}
+	var product interface{} = int32(1)
+	for _, arg := range args {
+		if !IsNumber(arg) {
+			return nil, fmt.Errorf("$multiply only supports numeric types, not %s", BSONType(arg))
+		}
+		var err error
+		if product, err = multiplyNumbers(product, arg); err != nil {
+			return nil, err
+		}
+	}
+	return product, nil
+}
+
+// divideExpression always returns a double, or a decimal when either
+// argument is one.
+func divideExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 2); err != nil {
+		return nil, err
+	}
+	if anyNull(args) {
+		return nil, nil
+	}
+	a, b := args[0], args[1]
+	if !IsNumber(a) || !IsNumber(b) {
+		return nil, fmt.Errorf("$divide only supports numeric types, not %s and %s", BSONType(a), BSONType(b))
+	}
+	if numberFloat(b) == 0 {
+		return nil, errors.New("can't $divide by zero")
+	}
+	_, decimalA := a.(primitive.Decimal128)
+	_, decimalB := b.(primitive.Decimal128)
+	if decimalA || decimalB {
+		return arithmetic(a, b, new(big.Float).Quo, nil, nil)
+	}
+	return numberFloat(a) / numberFloat(b), nil
+}
+
+func modExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 2); err != nil {
+		return nil, err
+	}
+	if anyNull(args) {
+		return nil, nil
+	}
+	a, b := args[0], args[1]
+	if !IsNumber(a) || !IsNumber(b) {
+		return nil, fmt.Errorf("$mod only supports numeric types, not %s and %s", BSONType(a), BSONType(b))
+	}
+	if numberFloat(b) == 0 {
+		return nil, errors.New("can't $mod by zero")
+	}
+	if _, isDecimal := a.(primitive.Decimal128); isDecimal {
+		return nil, errors.New("$mod does not support decimals")
+	}
+	if _, isDecimal := b.(primitive.Decimal128); isDecimal {
+		return nil, errors.New("$mod does not support decimals")
+	}
+	return arithmetic(a, b, nil, func(x, y int64) (int64, bool) {
+		if y == -1 {
+			return 0, true
+		}
+		return x % y, true
+	}, math.Mod)
+}
+
+func absExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 1); err != nil {
+		return nil, err
+	}
+	if isNull(args[0]) {
+		return nil, nil
+	}
+	if !IsNumber(args[0]) {
+		return nil, fmt.Errorf("$abs only supports numeric types, not %s", BSONType(args[0]))
+	}
+	if CompareValues(args[0], int32(0)) < 0 {
+		return multiplyNumbers(args[0], int32(-1))
+	}
+	return args[0], nil
+}
+
+// comparisonExpression compares two values of any types in BSON order.
+func comparisonExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 2); err != nil {
+		return nil, err
+	}
+	c := CompareValues(args[0], args[1])
+	switch operator {
+	case "$eq":
+		return c == 0, nil
+	case "$ne":
+		return c != 0, nil
+	case "$gt":
+		return c > 0, nil
+	case "$gte":
+		return c >= 0, nil
+	case "$lt":
+		return c < 0, nil
+	case "$lte":
+		return c <= 0, nil
+	}
+	return int32(c), nil
+}
+
+func notExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 1); err != nil {
+		return nil, err
+	}
+	return !truthy(args[0]), nil
+}
+
+func concatExpression(operator string, args []interface{}) (interface{}, error) {
+	var b strings.Builder
+	for _, arg := range args {
+		if isNull(arg) {
+			return nil, nil
+		}
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("$concat only supports strings, not %s", BSONType(arg))
+		}
+		b.WriteString(s)
+	}
+	return b.String(), nil
+}
+
+// caseExpression implements $toLower and $toUpper; null becomes the empty
+// string.
+func caseExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 1); err != nil {
+		return nil, err
+	}
+	if isNull(args[0]) {
+		return "", nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s only supports strings, not %s", operator, BSONType(args[0]))
+	}
+	if operator == "$toLower" {
+		return strings.ToLower(s), nil
+	}
+	return strings.ToUpper(s), nil
+}
+
+func sizeExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 1); err != nil {
+		return nil, err
+	}
+	elements, ok := AsArray(args[0])
+	if !ok {
+		return nil, fmt.Errorf("the argument to $size must be an array, but was of type: %s", BSONType(args[0]))
+	}
+	return int32(len(elements)), nil
+}
+
+// arrayElemAtExpression returns the element at an index, counted from the
+// end when negative. An index past either end has no value.
+func arrayElemAtExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 2); err != nil {
+		return nil, err
+	}
+	if anyNull(args) {
+		return nil, nil
+	}
+	elements, ok := AsArray(args[0])
+	if !ok {
+		return nil, fmt.Errorf("$arrayElemAt's first argument must be an array, but is %s", BSONType(args[0]))
+	}
+	i, err := integerModifier("$arrayElemAt", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		i += len(elements)
+	}
+	if i < 0 || i >= len(elements) {
+		return missingValue{}, nil
+	}
+	return elements[i], nil
+}
+
+func inExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 2); err != nil {
+		return nil, err
+	}
+	elements, ok := AsArray(args[1])
+	if !ok {
+		return nil, fmt.Errorf("$in requires an array as a second argument, found: %s", BSONType(args[1]))
+	}
+	return containsValue(elements, args[0]), nil
+}
+
+func isArrayExpression(operator string, args []interface{}) (interface{}, error) {
+	if err := argCount(operator, args, 1); err != nil {
+		return nil, err
+	}
+	_, ok := AsArray(args[0])
+	return ok, nil
+}
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GroupStage is a parsed $group stage: documents with the same _id
+// expression value are combined into one, with every other field computed
+// by an accumulator.
+type GroupStage struct {
+	id     interface{}
+	fields []groupField
+}
+
+type groupField struct {
+	name     string
+	operator string
+	expr     interface{}
+}
+
+// accumulator combines the values of one output field across a group.
+type accumulator interface {
+	// add takes the value of the field's expression for one document and
+	// whether it exists.
+	add(value interface{}, exists bool)
+	result() interface{}
+}
+
+var accumulators = map[string]func() accumulator{
+	"$sum":      func() accumulator { return &sumAccumulator{sum: int32(0)} },
+	"$avg":      func() accumulator { return &avgAccumulator{sum: int32(0)} },
+	"$min":      func() accumulator { return &extremeAccumulator{sign: -1} },
+	"$max":      func() accumulator { return &extremeAccumulator{sign: 1} },
+	"$first":    func() accumulator { return &firstAccumulator{} },
+	"$last":     func() accumulator { return &lastAccumulator{} },
+	"$push":     func() accumulator { return &pushAccumulator{values: []interface{}{}} },
+	"$addToSet": func() accumulator { return &addToSetAccumulator{values: []interface{}{}, seen: map[string]bool{}} },
+	"$count":    func() accumulator { return &sumAccumulator{sum: int32(0)} },
+}
+
+// ParseGroupStage validates the specification of a $group stage. It must
+// have an _id, which may be any expression, including a document of
+// expressions for a compound key, and each other field must be a single
+// accumulator such as {"$sum": "$amount"}.
+func ParseGroupStage(spec interface{}) (*GroupStage, error) {
+	fields, ok := AsDocument(spec)
+	if !ok {
+		return nil, errors.New("a group's fields must be specified in an object")
+	}
+	id, ok := fields["_id"]
+	if !ok {
+		return nil, errors.New("a group specification must include an _id")
+	}
+	stage := &GroupStage{id: id}
+	for _, name := range sortedKeys(fields) {
+		if name == "_id" {
+			continue
+		}
+		if strings.Contains(name, ".") || strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("the group aggregate field name '%s' cannot be used because $group's field names cannot contain '.' or start with '$'", name)
+		}
+		operation, ok := AsDocument(fields[name])
+		if !ok || len(operation) != 1 {
+			return nil, fmt.Errorf("the field '%s' must be an accumulator object", name)
+		}
+		for operator, expr := range operation {
+			if _, ok := accumulators[operator]; !ok {
+				return nil, fmt.Errorf("unknown group operator '%s'", operator)
+			}
+			if operator == "$count" {
+				if args, ok := AsDocument(expr); !ok || len(args) != 0 {
+					return nil, errors.New("$count takes no arguments, i.e. $count:{}")
+				}
+				expr = int32(1)
+			}
+			stage.fields = append(stage.fields, groupField{name: name, operator: operator, expr: expr})
+		}
+	}
+	return stage, nil
+}
+
+// Apply groups docs, returning one document per distinct _id value in the
+// order the groups were first met. A missing _id value groups as null.
+func (s *GroupStage) Apply(docs []Document, vars Variables) ([]Document, error) {
+	type group struct {
+		id           interface{}
+		accumulators []accumulator
+	}
+	var groups []*group
+	byKey := make(map[string]*group)
+	for _, doc := range docs {
+		id, _, err := EvaluateExpression(s.id, doc, vars)
+		if err != nil {
+			return nil, err
+		}
+		key := KeyString(id)
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{id: id}
+			for _, field := range s.fields {
+				g.accumulators = append(g.accumulators, accumulators[field.operator]())
+			}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		for i, field := range s.fields {
+			value, exists, err := EvaluateExpression(field.expr, doc, vars)
+			if err != nil {
+				return nil, err
+			}
+			g.accumulators[i].add(value, exists)
+		}
+	}
+	results := make([]Document, len(groups))
+	for i, g := range groups {
+		result := Document{"_id": CopyValue(g.id)}
+		for j, field := range s.fields {
+			result[field.name] = g.accumulators[j].result()
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// sumNumbers adds b to a, widening to a double when a long sum overflows.
+func sumNumbers(a, b interface{}) interface{} {
+	sum, err := addNumbers(a, b)
+	if err != nil {
+		return numberFloat(a) + numberFloat(b)
+	}
+	return sum
+}
+
+// sumAccumulator implements $sum and $count. Values that are not numbers,
+// including null and missing ones, are ignored.
+type sumAccumulator struct {
+	sum interface{}
+}
+
+func (a *sumAccumulator) add(value interface{}, exists bool) {
+	if IsNumber(value) {
+		a.sum = sumNumbers(a.sum, value)
+	}
+}
+
+func (a *sumAccumulator) result() interface{} {
+	return a.sum
+}
+
+// avgAccumulator implements $avg, which is null when no value is a number.
+// The average is a double, or a decimal when any value is one.
+type avgAccumulator struct {
+	sum   interface{}
+	count int64
+}
+
+func (a *avgAccumulator) add(value interface{}, exists bool) {
+	if IsNumber(value) {
+		a.sum = sumNumbers(a.sum, value)
+		a.count++
+	}
+}
+
+func (a *avgAccumulator) result() interface{} {
+	if a.count == 0 {
+		return nil
+	}
+	if _, isDecimal := a.sum.(primitive.Decimal128); isDecimal {
+		avg, err := arithmetic(a.sum, a.count, new(big.Float).Quo, nil, nil)
+		if err == nil {
+			return avg
+		}
+	}
+	return numberFloat(a.sum) / float64(a.count)
+}
+
+// extremeAccumulator implements $min and $max in BSON order, ignoring null
+// and missing values. It is null when there are no other values.
+type extremeAccumulator struct {
+	sign  int
+	value interface{}
+	found bool
+}
+
+func (a *extremeAccumulator) add(value interface{}, exists bool) {
+	if !exists || isNull(value) {
+		return
+	}
+	if !a.found || CompareValues(value, a.value)*a.sign > 0 {
+		a.value, a.found = CopyValue(value), true
+	}
+}
+
+func (a *extremeAccumulator) result() interface{} {
+	return a.value
+}
+
+// firstAccumulator implements $first; a missing value counts as null.
+type firstAccumulator struct {
+	value interface{}
+	found bool
+}
+
+func (a *firstAccumulator) add(value interface{}, exists bool) {
+	if !a.found {
+		a.value, a.found = CopyValue(value), true
+	}
+}
+
+func (a *firstAccumulator) result() interface{} {
+	return a.value
+}
+
+// lastAccumulator implements $last; a missing value counts as null.
+type lastAccumulator struct {
+	value interface{}
+}
+
+func (a *lastAccumulator) add(value interface{}, exists bool) {
+	a.value = CopyValue(value)
+}
+
+func (a *lastAccumulator) result() interface{} {
+	return a.value
+}
+
+// pushAccumulator implements $push. Missing values are left out; nulls are
+// kept.
+type pushAccumulator struct {
+	values []interface{}
+}
+
+func (a *pushAccumulator) add(value interface{}, exists bool) {
+	if exists {
+		a.values = append(a.values, CopyValue(value))
+	}
+}
+
+func (a *pushAccumulator) result() interface{} {
+	return a.values
+}
+
+// addToSetAccumulator implements $addToSet, keeping the first of the values
+// that compare equal.
+type addToSetAccumulator struct {
+	values []interface{}
+	seen   map[string]bool
+}
+
+func (a *addToSetAccumulator) add(value interface{}, exists bool) {
+	if !exists {
+		return
+	}
+	if key := KeyString(value); !a.seen[key] {
+		a.seen[key] = true
+		a.values = append(a.values, CopyValue(value))
+	}
+}
+
+func (a *addToSetAccumulator) result() interface{} {
+	return a.values
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// KeyString encodes v as a string that is the same for values EqualValues
+// considers equal, such as the integer 1 and the double 1.0, so values can be
+// used as map keys in indexes and de-duplication.
+func KeyString(v interface{}) string {
+	var b strings.Builder
+	writeKey(&b, v)
+	return b.String()
+}
+
+func writeKey(b *strings.Builder, v interface{}) {
+	if IsNumber(v) {
+		b.WriteString("n:")
+		if f, nan := bigNumber(v); nan {
+			b.WriteString("NaN")
+		} else {
+			b.WriteString(f.Text('g', -1))
+		}
+		return
+	}
+	if d, ok := AsDocument(v); ok {
+		b.WriteString("{")
+		for i, key := range sortedKeys(d) {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(strconv.Quote(key))
+			b.WriteString(":")
+			writeKey(b, d[key])
+		}
+		b.WriteString("}")
+		return
+	}
+	if elements, ok := AsArray(v); ok {
+		b.WriteString("[")
+		for i, elem := range elements {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			writeKey(b, elem)
+		}
+		b.WriteString("]")
+		return
+	}
+	switch x := v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		b.WriteString("null")
+	case string:
+		b.WriteString("s:" + strconv.Quote(x))
+	case primitive.Symbol:
+		b.WriteString("s:" + strconv.Quote(string(x)))
+	case time.Time, primitive.DateTime:
+		b.WriteString("date:" + strconv.FormatInt(timeValue(x).UnixNano(), 10))
+	default:
+		fmt.Fprintf(b, "%T:%v", v, v)
+	}
+}
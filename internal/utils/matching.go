@@ -1,80 +1,440 @@
 package utils
 
 import (
-	"reflect"
+	"errors"
+	"fmt"
+	"regexp"
 	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Document map[string]interface{}
 
-func MatchesFilter(doc Document, filter Document) bool {
+// MatchesFilter reports whether doc satisfies every clause of filter. Besides
+// field conditions, a filter may use the logical operators $and, $or and $nor
+// at any level of nesting, and $expr to match on an aggregation expression.
+func MatchesFilter(doc Document, filter Document) (bool, error) {
+	return MatchesFilterWithVariables(doc, filter, nil)
+}
+
+// MatchesFilterWithVariables is MatchesFilter with vars available to the
+// expressions of $expr clauses, as in the sub-pipeline of a $lookup.
+func MatchesFilterWithVariables(doc Document, filter Document, vars Variables) (bool, error) {
 	for key, value := range filter {
-		if !MatchField(doc, key, value) {
-			return false
+		var matched bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			matched, err = matchLogical(doc, key, value, vars)
+		case "$expr":
+			var result interface{}
+			result, _, err = EvaluateExpression(value, doc, vars)
+			matched = truthy(result)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unknown top level operator: %s", key)
+			}
+			matched, err = MatchField(doc, key, value)
+		}
+		if err != nil || !matched {
+			return false, err
 		}
 	}
-	return true
+	return true, nil
 }
 
-func MatchField(doc Document, key string, value interface{}) bool {
-	docValue, exists := doc[key]
-	if !exists {
-		return false
+func matchLogical(doc Document, operator string, value interface{}, vars Variables) (bool, error) {
+	clauses, ok := AsArray(value)
+	if !ok || len(clauses) == 0 {
+		return false, fmt.Errorf("%s must be a nonempty array", operator)
+	}
+	for _, clause := range clauses {
+		subFilter, ok := AsDocument(clause)
+		if !ok {
+			return false, fmt.Errorf("%s argument's entries must be objects", operator)
+		}
+		matched, err := MatchesFilterWithVariables(doc, subFilter, vars)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case operator == "$and" && !matched:
+			return false, nil
+		case operator == "$or" && matched:
+			return true, nil
+		case operator == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return operator != "$or", nil
+}
+
+// MatchField reports whether the value at key, which may be a dotted path,
+// satisfies value. A path that fans out through arrays matches when any of
+// the values it reaches does.
+func MatchField(doc Document, key string, value interface{}) (bool, error) {
+	values := ResolvePath(doc, key)
+	if isRegex(value) {
+		re, err := compileRegex(value, "")
+		if err != nil {
+			return false, err
+		}
+		return matchAny(values, "$regex", re)
+	}
+	operators, ok := operatorDocument(value)
+	if !ok {
+		return matchAny(values, "$eq", value)
+	}
+	return matchOperators(values, operators)
+}
+
+// operatorDocument returns value as an operator document such as {"$gt": 5}.
+// Documents without any "$" keys are literal values to compare against.
+func operatorDocument(value interface{}) (map[string]interface{}, bool) {
+	d, ok := AsDocument(value)
+	if !ok {
+		return nil, false
+	}
+	for key := range d {
+		if strings.HasPrefix(key, "$") {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// fieldOperators lists the operators accepted inside an operator document.
+var fieldOperators = map[string]bool{
+	"$eq":        true,
+	"$ne":        true,
+	"$gt":        true,
+	"$gte":       true,
+	"$lt":        true,
+	"$lte":       true,
+	"$in":        true,
+	"$nin":       true,
+	"$exists":    true,
+	"$type":      true,
+	"$not":       true,
+	"$all":       true,
+	"$size":      true,
+	"$elemMatch": true,
+	"$regex":     true,
+	"$options":   true,
+}
+
+// matchOperators evaluates an operator document against the values found at
+// a path. Every operator must match, so {"$gt": 20, "$lt": 30} is a range.
+// Negated operators such as $ne and $nin are the inverse of their positive
+// form over all values, so they also match a missing field.
+func matchOperators(values []interface{}, operators map[string]interface{}) (bool, error) {
+	for operator := range operators {
+		if !fieldOperators[operator] {
+			return false, fmt.Errorf("unknown operator: %s", operator)
+		}
+	}
+	if _, ok := operators["$regex"]; ok {
+		options, _ := operators["$options"].(string)
+		re, err := compileRegex(operators["$regex"], options)
+		if err != nil {
+			return false, err
+		}
+		matched, err := matchAny(values, "$regex", re)
+		if err != nil || !matched {
+			return false, err
+		}
+	} else if _, ok := operators["$options"]; ok {
+		return false, errors.New("$options needs a $regex")
+	}
+	for operator, operand := range operators {
+		if operator == "$regex" || operator == "$options" {
+			continue
+		}
+		matched, err := matchOperator(values, operator, operand)
+		if err != nil || !matched {
+			return false, err
+		}
 	}
+	return true, nil
+}
 
-	switch v := value.(type) {
-	case map[string]interface{}:
-		for operator, operand := range v {
-			switch operator {
-			case "$eq":
-				return reflect.DeepEqual(docValue, operand)
-			case "$ne":
-				return !reflect.DeepEqual(docValue, operand)
-			case "$gt":
-				return compare(docValue, operand) > 0
-			case "$gte":
-				return compare(docValue, operand) >= 0
-			case "$lt":
-				return compare(docValue, operand) < 0
-			case "$lte":
-				return compare(docValue, operand) <= 0
-			// Add more operators as needed
-			default:
-				return false
+func matchOperator(values []interface{}, operator string, operand interface{}) (bool, error) {
+	switch operator {
+	case "$not":
+		if isRegex(operand) {
+			re, err := compileRegex(operand, "")
+			if err != nil {
+				return false, err
 			}
+			matched, err := matchAny(values, "$regex", re)
+			return !matched && err == nil, err
 		}
+		inner, ok := operatorDocument(operand)
+		if !ok {
+			return false, errors.New("$not needs a regex or a document")
+		}
+		matched, err := matchOperators(values, inner)
+		return !matched && err == nil, err
+	case "$ne":
+		matched, err := matchAny(values, "$eq", operand)
+		return !matched && err == nil, err
+	case "$nin":
+		matched, err := matchAny(values, "$in", operand)
+		return !matched && err == nil, err
+	case "$exists":
+		return (len(values) > 0) == truthy(operand), nil
+	case "$all":
+		return matchAll(values, operand)
 	default:
-		return reflect.DeepEqual(docValue, value)
+		return matchAny(values, operator, operand)
 	}
-	return false
 }
 
-func compare(a, b interface{}) int {
-	// Implement comparison logic for supported types
-	switch a := a.(type) {
-	case int:
-		if bInt, ok := b.(int); ok {
-			if a < bInt {
-				return -1
-			} else if a > bInt {
-				return 1
+// arrayOperators apply to an array as a whole rather than to its elements.
+var arrayOperators = map[string]bool{
+	"$size":      true,
+	"$elemMatch": true,
+}
+
+// matchAny reports whether any of values satisfies a single operator. An empty
+// values slice stands for a missing field, which only equals null. Array
+// values match when either the array itself or any of its elements does.
+func matchAny(values []interface{}, operator string, operand interface{}) (bool, error) {
+	if len(values) == 0 {
+		return matchValue(nil, false, operator, operand)
+	}
+	for _, value := range values {
+		if elements, isArray := AsArray(value); isArray && !arrayOperators[operator] {
+			for _, elem := range elements {
+				matched, err := matchValue(elem, true, operator, operand)
+				if err != nil || matched {
+					return matched, err
+				}
 			}
-			return 0
-		}
-	case float64:
-		if bFloat, ok := b.(float64); ok {
-			if a < bFloat {
-				return -1
-			} else if a > bFloat {
-				return 1
+			// Ranges only compare a whole array against another array.
+			if _, operandIsArray := AsArray(operand); isRangeOperator(operator) && !operandIsArray {
+				continue
 			}
-			return 0
 		}
-	case string:
-		if bStr, ok := b.(string); ok {
-			return strings.Compare(a, bStr)
+		matched, err := matchValue(value, true, operator, operand)
+		if err != nil || matched {
+			return matched, err
 		}
 	}
-	// Types are not comparable
-	return 0
+	return false, nil
+}
+
+func isRangeOperator(operator string) bool {
+	return operator == "$gt" || operator == "$gte" || operator == "$lt" || operator == "$lte"
+}
+
+// comparableTypes applies type bracketing: range operators only match values
+// in the same comparison group as the operand, so {"$gt": 5} never matches a
+// string. MinKey and MaxKey operands bound every type.
+func comparableTypes(docValue, operand interface{}) bool {
+	switch operand.(type) {
+	case primitive.MinKey, primitive.MaxKey:
+		return true
+	}
+	return TypeRank(docValue) == TypeRank(operand)
+}
+
+func matchValue(docValue interface{}, exists bool, operator string, operand interface{}) (bool, error) {
+	switch operator {
+	case "$eq":
+		return EqualValues(docValue, operand), nil
+	case "$in":
+		return matchIn(docValue, operand)
+	}
+	if !exists {
+		// Inclusive bounds on null are equality, which a missing field meets.
+		return (operator == "$gte" || operator == "$lte") && operand == nil, nil
+	}
+	if isRangeOperator(operator) && !comparableTypes(docValue, operand) {
+		return false, nil
+	}
+	switch operator {
+	case "$regex":
+		return matchRegex(docValue, operand.(*regexp.Regexp)), nil
+	case "$type":
+		return matchType(docValue, operand)
+	case "$size":
+		return matchSize(docValue, operand)
+	case "$elemMatch":
+		return matchElemMatch(docValue, operand)
+	case "$gt":
+		return CompareValues(docValue, operand) > 0, nil
+	case "$gte":
+		return CompareValues(docValue, operand) >= 0, nil
+	case "$lt":
+		return CompareValues(docValue, operand) < 0, nil
+	case "$lte":
+		return CompareValues(docValue, operand) <= 0, nil
+	default:
+		return false, fmt.Errorf("unknown operator: %s", operator)
+	}
+}
+
+func matchIn(docValue interface{}, operand interface{}) (bool, error) {
+	candidates, ok := AsArray(operand)
+	if !ok {
+		return false, errors.New("$in needs an array")
+	}
+	for _, candidate := range candidates {
+		if isRegex(candidate) {
+			re, err := compileRegex(candidate, "")
+			if err != nil {
+				return false, err
+			}
+			if matchRegex(docValue, re) {
+				return true, nil
+			}
+		} else if EqualValues(docValue, candidate) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchAll requires every item of the $all operand to match the field, either
+// as a value or as an {"$elemMatch": ...} document.
+func matchAll(values []interface{}, operand interface{}) (bool, error) {
+	items, ok := AsArray(operand)
+	if !ok {
+		return false, errors.New("$all needs an array")
+	}
+	if len(items) == 0 {
+		return false, nil
+	}
+	for _, item := range items {
+		var matched bool
+		var err error
+		if criteria, ok := operatorDocument(item); ok && criteria["$elemMatch"] != nil {
+			matched, err = matchAny(values, "$elemMatch", criteria["$elemMatch"])
+		} else if isRegex(item) {
+			var re *regexp.Regexp
+			if re, err = compileRegex(item, ""); err == nil {
+				matched, err = matchAny(values, "$regex", re)
+			}
+		} else {
+			matched, err = matchAny(values, "$eq", item)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchSize(docValue interface{}, operand interface{}) (bool, error) {
+	size, ok := toFloat(operand)
+	if !ok || size != float64(int(size)) {
+		return false, fmt.Errorf("$size needs an integer, got %v", operand)
+	}
+	elements, isArray := AsArray(docValue)
+	return isArray && len(elements) == int(size), nil
+}
+
+// matchElemMatch reports whether a single array element satisfies every
+// criterion. Criteria made only of operators, such as {"$gte": 80, "$lt": 85},
+// apply to the elements themselves; anything else is a query that embedded
+// document elements must match.
+func matchElemMatch(docValue interface{}, operand interface{}) (bool, error) {
+	criteria, ok := AsDocument(operand)
+	if !ok {
+		return false, errors.New("$elemMatch needs an Object")
+	}
+	elements, isArray := AsArray(docValue)
+	if !isArray {
+		return false, nil
+	}
+	valueForm := isValueCondition(criteria)
+	for _, elem := range elements {
+		matched, err := matchElement(elem, criteria, valueForm)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// isValueCondition reports whether criteria is made only of field operators,
+// so it applies to values rather than being a query on embedded documents.
+func isValueCondition(criteria map[string]interface{}) bool {
+	for key := range criteria {
+		if !strings.HasPrefix(key, "$") || key == "$and" || key == "$or" || key == "$nor" {
+			return false
+		}
+	}
+	return len(criteria) > 0
+}
+
+func matchElement(elem interface{}, criteria map[string]interface{}, valueForm bool) (bool, error) {
+	if !valueForm {
+		doc, ok := AsDocument(elem)
+		if !ok {
+			return false, nil
+		}
+		return MatchesFilter(doc, criteria)
+	}
+	return matchOperators([]interface{}{elem}, criteria)
+}
+
+// matchType checks docValue against a $type operand, which is a BSON type
+// alias such as "string", a numeric type code, or an array of either.
+func matchType(docValue interface{}, operand interface{}) (bool, error) {
+	types, ok := AsArray(operand)
+	if !ok {
+		types = []interface{}{operand}
+	}
+	actual := BSONType(docValue)
+	for _, t := range types {
+		alias, err := typeAlias(t)
+		if err != nil {
+			return false, err
+		}
+		if alias == actual || (alias == "number" && isNumberType(actual)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func typeAlias(t interface{}) (string, error) {
+	if name, ok := t.(string); ok {
+		if _, known := bsonTypeCodes[name]; known || name == "number" {
+			return name, nil
+		}
+		return "", fmt.Errorf("unknown type name alias: %s", name)
+	}
+	code, ok := toFloat(t)
+	if !ok {
+		return "", fmt.Errorf("type must be represented as a number or a string, got %v", t)
+	}
+	for name, c := range bsonTypeCodes {
+		if float64(c) == code {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("invalid numerical type code: %v", t)
+}
+
+func isNumberType(alias string) bool {
+	return alias == "double" || alias == "int" || alias == "long" || alias == "decimal"
+}
+
+// truthy follows the query language's loose boolean rules, where any
+// non-zero number counts as true.
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
 }
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResolvePath returns every value reachable at a dotted path such as
+// "Items.ProductID". Arrays met along the way are traversed implicitly, so a
+// path can fan out to one value per embedded document, and numeric segments
+// such as "Items.0.Price" index into arrays. A missing path yields no values.
+func ResolvePath(doc map[string]interface{}, path string) []interface{} {
+	return resolveSegments(doc, strings.Split(path, "."))
+}
+
+func resolveSegments(node interface{}, segments []string) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{node}
+	}
+	if d, ok := AsDocument(node); ok {
+		child, exists := d[segments[0]]
+		if !exists {
+			return nil
+		}
+		return resolveSegments(child, segments[1:])
+	}
+	arr, ok := AsArray(node)
+	if !ok {
+		return nil
+	}
+	var results []interface{}
+	if i, ok := arrayIndex(segments[0]); ok && i < len(arr) {
+		results = append(results, resolveSegments(arr[i], segments[1:])...)
+	}
+	// Embedded documents are searched too, since "0" is also a valid field name.
+	for _, elem := range arr {
+		if _, isDoc := AsDocument(elem); isDoc {
+			results = append(results, resolveSegments(elem, segments)...)
+		}
+	}
+	return results
+}
+
+// LookupPath returns the single value stored at a dotted path. Unlike
+// ResolvePath it never fans out: arrays can only be entered by numeric index.
+func LookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	var node interface{} = doc
+	for _, segment := range strings.Split(path, ".") {
+		if d, ok := AsDocument(node); ok {
+			child, exists := d[segment]
+			if !exists {
+				return nil, false
+			}
+			node = child
+			continue
+		}
+		arr, ok := AsArray(node)
+		if !ok {
+			return nil, false
+		}
+		i, ok := arrayIndex(segment)
+		if !ok || i >= len(arr) {
+			return nil, false
+		}
+		node = arr[i]
+	}
+	return node, true
+}
+
+// SetPath stores value at a dotted path, creating any missing embedded
+// documents on the way. Numeric segments address array elements, padding the
+// array with nulls when the index is past its end.
+func SetPath(doc map[string]interface{}, path string, value interface{}) error {
+	_, err := setSegments(doc, strings.Split(path, "."), value)
+	return err
+}
+
+// setSegments returns the updated node, which differs from the one passed in
+// when an array had to grow or a foreign map type was converted.
+func setSegments(node interface{}, segments []string, value interface{}) (interface{}, error) {
+	segment := segments[0]
+	if d, ok := AsDocument(node); ok {
+		if len(segments) == 1 {
+			d[segment] = value
+			return d, nil
+		}
+		child, exists := d[segment]
+		if !exists {
+			child = map[string]interface{}{}
+		}
+		updated, err := setSegments(child, segments[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[segment] = updated
+		return d, nil
+	}
+	if arr, ok := AsArray(node); ok {
+		i, ok := arrayIndex(segment)
+		if !ok {
+			return nil, fmt.Errorf("cannot create field '%s' in array element", segment)
+		}
+		for len(arr) <= i {
+			arr = append(arr, nil)
+		}
+		if len(segments) == 1 {
+			arr[i] = value
+			return arr, nil
+		}
+		child := arr[i]
+		if child == nil {
+			child = map[string]interface{}{}
+		}
+		updated, err := setSegments(child, segments[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = updated
+		return arr, nil
+	}
+	return nil, fmt.Errorf("cannot create field '%s' in element %v", segment, node)
+}
+
+// UnsetPath removes the field at a dotted path. Array elements are set to
+// null rather than removed, so the positions of other elements are kept. It
+// reports whether anything was removed.
+func UnsetPath(doc map[string]interface{}, path string) bool {
+	segments := strings.Split(path, ".")
+	parent, ok := LookupPath(doc, strings.Join(segments[:len(segments)-1], "."))
+	if len(segments) == 1 {
+		parent, ok = doc, true
+	}
+	if !ok {
+		return false
+	}
+	last := segments[len(segments)-1]
+	if d, isDoc := AsDocument(parent); isDoc {
+		if _, exists := d[last]; !exists {
+			return false
+		}
+		delete(d, last)
+		return true
+	}
+	if arr, isArr := parent.([]interface{}); isArr {
+		if i, ok := arrayIndex(last); ok && i < len(arr) {
+			arr[i] = nil
+			return true
+		}
+	}
+	return false
+}
+
+func arrayIndex(segment string) (int, bool) {
+	i, err := strconv.Atoi(segment)
+	if err != nil || i < 0 || strings.HasPrefix(segment, "+") {
+		return 0, false
+	}
+	return i, true
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// isPositionalSegment reports whether a path segment is one of the positional
+// operators $, $[] or $[identifier].
+func isPositionalSegment(segment string) bool {
+	return segment == "$" || (strings.HasPrefix(segment, "$[") && strings.HasSuffix(segment, "]"))
+}
+
+func hasPositional(path string) bool {
+	for _, segment := range strings.Split(path, ".") {
+		if isPositionalSegment(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArrayFilters indexes the arrayFilters option by identifier. Every
+// filter document must refer to exactly one identifier, as in
+// {"item.Price": {"$gt": 50}}, and identifiers must be unique.
+func parseArrayFilters(filters []interface{}) (map[string]Document, error) {
+	result := make(map[string]Document, len(filters))
+	for _, f := range filters {
+		filter, ok := AsDocument(f)
+		if !ok {
+			return nil, errors.New("array filters must be documents")
+		}
+		identifier := ""
+		for key := range filter {
+			name := strings.SplitN(key, ".", 2)[0]
+			if identifier != "" && name != identifier {
+				return nil, fmt.Errorf("error parsing array filter: expected a single top-level field name, found '%s' and '%s'", identifier, name)
+			}
+			identifier = name
+		}
+		if identifier == "" || strings.HasPrefix(identifier, "$") {
+			return nil, errors.New("cannot use an expression without a top-level field name in arrayFilters")
+		}
+		if _, exists := result[identifier]; exists {
+			return nil, fmt.Errorf("found multiple array filters with the same top-level field name %s", identifier)
+		}
+		result[identifier] = filter
+	}
+	return result, nil
+}
+
+// checkArrayFilterUse makes sure every $[identifier] in the update has an
+// array filter and every array filter is used.
+func checkArrayFilterUse(update Document, filters map[string]Document) error {
+	used := make(map[string]bool)
+	for _, operand := range update {
+		fields, _ := AsDocument(operand)
+		for path := range fields {
+			for _, segment := range strings.Split(path, ".") {
+				if !strings.HasPrefix(segment, "$[") || segment == "$[]" || !isPositionalSegment(segment) {
+					continue
+				}
+				identifier := segment[2 : len(segment)-1]
+				if _, ok := filters[identifier]; !ok {
+					return fmt.Errorf("no array filter found for identifier '%s' in path '%s'", identifier, path)
+				}
+				used[identifier] = true
+			}
+		}
+	}
+	for identifier := range filters {
+		if !used[identifier] {
+			return fmt.Errorf("the array filter for identifier '%s' was not used in the update", identifier)
+		}
+	}
+	return nil
+}
+
+// expandPath resolves the positional segments of an update path into the
+// concrete paths they stand for in doc: $ becomes the index of the array
+// element the query matched, $[] every index and $[identifier] the indexes
+// of the elements matching that identifier's array filter.
+func expandPath(doc Document, path string, ctx *UpdateContext, filters map[string]Document) ([]string, error) {
+	if !hasPositional(path) {
+		return []string{path}, nil
+	}
+	return expandSegments(doc, doc, nil, strings.Split(path, "."), ctx, filters)
+}
+
+func expandSegments(doc Document, node interface{}, prefix, rest []string, ctx *UpdateContext, filters map[string]Document) ([]string, error) {
+	if len(rest) == 0 {
+		return []string{strings.Join(prefix, ".")}, nil
+	}
+	segment := rest[0]
+	if !isPositionalSegment(segment) {
+		var child interface{}
+		if d, ok := AsDocument(node); ok {
+			child = d[segment]
+		} else if elements, ok := AsArray(node); ok {
+			if i, ok := arrayIndex(segment); ok && i < len(elements) {
+				child = elements[i]
+			}
+		}
+		return expandSegments(doc, child, appendSegment(prefix, segment), rest[1:], ctx, filters)
+	}
+	arrayPath := strings.Join(prefix, ".")
+	elements, ok := AsArray(node)
+	if !ok {
+		return nil, fmt.Errorf("the path '%s' must exist in the document in order to apply array updates", arrayPath)
+	}
+	var indexes []int
+	switch {
+	case segment == "$":
+		var filter Document
+		if ctx != nil {
+			filter = ctx.Filter
+		}
+		i, err := positionalIndex(doc, arrayPath, elements, filter)
+		if err != nil {
+			return nil, err
+		}
+		indexes = []int{i}
+	case segment == "$[]":
+		for i := range elements {
+			indexes = append(indexes, i)
+		}
+	default:
+		identifier := segment[2 : len(segment)-1]
+		for i, elem := range elements {
+			matched, err := MatchesFilter(Document{identifier: elem}, filters[identifier])
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	var paths []string
+	for _, i := range indexes {
+		expanded, err := expandSegments(doc, elements[i], appendSegment(prefix, strconv.Itoa(i)), rest[1:], ctx, filters)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, expanded...)
+	}
+	return paths, nil
+}
+
+func appendSegment(prefix []string, segment string) []string {
+	return append(append([]string{}, prefix...), segment)
+}
+
+// positionalIndex finds the first element of the array at arrayPath that the
+// query matched, by checking the query against the document with the array
+// narrowed down to one element at a time.
+func positionalIndex(doc Document, arrayPath string, elements []interface{}, filter Document) (int, error) {
+	if filterReferences(filter, arrayPath) {
+		for i, elem := range elements {
+			probe := Document(CopyValue(map[string]interface{}(doc)).(map[string]interface{}))
+			if err := SetPath(probe, arrayPath, []interface{}{elem}); err != nil {
+				return 0, err
+			}
+			matched, err := MatchesFilter(probe, filter)
+			if err != nil {
+				return 0, err
+			}
+			if matched {
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("the positional operator did not find the match needed from the query")
+}
+
+// filterReferences reports whether any condition in filter, including those
+// nested in logical operators, is on path or a field below it.
+func filterReferences(filter map[string]interface{}, path string) bool {
+	for key, value := range filter {
+		if key == "$and" || key == "$or" || key == "$nor" {
+			clauses, _ := AsArray(value)
+			for _, clause := range clauses {
+				if sub, ok := AsDocument(clause); ok && filterReferences(sub, path) {
+					return true
+				}
+			}
+			continue
+		}
+		if key == path || strings.HasPrefix(key, path+".") {
+			return true
+		}
+	}
+	return false
+}
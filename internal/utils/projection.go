@@ -0,0 +1,333 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Projection is a parsed projection document, such as {"name": 1} or
+// {"password": 0, "comments": {"$slice": -5}}.
+type Projection struct {
+	// inclusion is set when the projection lists the fields to return
+	// rather than the fields to leave out.
+	inclusion bool
+	excludeID bool
+	fields    *projectionNode
+	slices    map[string]interface{}
+	// elemMatches holds the $elemMatch conditions by field.
+	elemMatches map[string]Document
+	// positional is the array path of an "array.$" projection.
+	positional string
+}
+
+// projectionNode is a tree of projected paths. A leaf stands for the whole
+// value at its path.
+type projectionNode struct {
+	children map[string]*projectionNode
+}
+
+func (n *projectionNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// add inserts path into the tree, reporting paths that collide, like "a"
+// and "a.b".
+func (n *projectionNode) add(path string) error {
+	node := n
+	segments := strings.Split(path, ".")
+	for i, segment := range segments {
+		child, exists := node.children[segment]
+		switch {
+		case exists && (child.leaf() || i == len(segments)-1):
+			return fmt.Errorf("path collision at %s", path)
+		case !exists:
+			child = &projectionNode{children: map[string]*projectionNode{}}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	return nil
+}
+
+// ParseProjection validates a projection. Fields set to 1 or true are
+// included and fields set to 0 or false excluded; the two cannot be mixed
+// except to exclude _id, which is otherwise always returned. A field may
+// also be projected with {"$slice": n}, {"$slice": [skip, n]} or
+// {"$elemMatch": condition}, and "array.$" returns the first array element
+// the query matched.
+func ParseProjection(spec interface{}) (*Projection, error) {
+	fields, ok := AsDocument(spec)
+	if !ok {
+		return nil, errors.New("projection must be a document")
+	}
+	p := &Projection{
+		fields:      &projectionNode{children: map[string]*projectionNode{}},
+		slices:      make(map[string]interface{}),
+		elemMatches: make(map[string]Document),
+	}
+	included, excluded := 0, 0
+	includeID := false
+	for _, path := range sortedKeys(fields) {
+		value := fields[path]
+		if path == "" || strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("projection field name cannot be empty or start with '$': %s", path)
+		}
+		if operators, ok := AsDocument(value); ok {
+			if err := p.addOperator(path, operators); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		include, ok := projectionFlag(value)
+		if !ok {
+			return nil, fmt.Errorf("unsupported projection value for %s: %v", path, value)
+		}
+		if path == "_id" {
+			// _id is kept unless excluded, so it needs no place among the
+			// other fields, but including it alone makes an inclusion.
+			p.excludeID = !include
+			includeID = include
+			continue
+		}
+		if strings.HasSuffix(path, ".$") {
+			if !include || p.positional != "" {
+				return nil, errors.New("positional projection must be included and cannot be used more than once")
+			}
+			path = strings.TrimSuffix(path, ".$")
+			p.positional = path
+		}
+		if strings.Contains(path, ".$") {
+			return nil, fmt.Errorf("positional projection may only be used at the end of a path: %s", path)
+		}
+		if include {
+			included++
+		} else {
+			excluded++
+		}
+		if err := p.fields.add(path); err != nil {
+			return nil, err
+		}
+	}
+	if included > 0 && excluded > 0 {
+		return nil, errors.New("cannot mix inclusion and exclusion in a projection, except to exclude _id")
+	}
+	p.inclusion = included > 0 || (includeID && excluded == 0) || len(p.elemMatches) > 0 || p.positional != ""
+	if !p.inclusion && excluded > 0 && (len(p.elemMatches) > 0 || p.positional != "") {
+		return nil, errors.New("cannot use $elemMatch or a positional projection in an exclusion projection")
+	}
+	return p, nil
+}
+
+func (p *Projection) addOperator(path string, operators map[string]interface{}) error {
+	if len(operators) != 1 {
+		return fmt.Errorf("projection for %s must have exactly one operator", path)
+	}
+	if arg, ok := operators["$slice"]; ok {
+		if err := checkSlice(arg); err != nil {
+			return fmt.Errorf("$slice for %s: %w", path, err)
+		}
+		p.slices[path] = arg
+		return nil
+	}
+	if condition, ok := operators["$elemMatch"]; ok {
+		criteria, ok := AsDocument(condition)
+		if !ok {
+			return fmt.Errorf("$elemMatch for %s needs an Object", path)
+		}
+		if strings.Contains(path, ".") {
+			return fmt.Errorf("cannot use $elemMatch projection on a nested field: %s", path)
+		}
+		p.elemMatches[path] = criteria
+		return p.fields.add(path)
+	}
+	for operator := range operators {
+		return fmt.Errorf("unsupported projection operator %s for %s", operator, path)
+	}
+	return nil
+}
+
+// projectionFlag interprets an inclusion or exclusion value.
+func projectionFlag(v interface{}) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0, true
+	}
+	return false, false
+}
+
+func checkSlice(arg interface{}) error {
+	if _, err := integerModifier("$slice", arg); err == nil {
+		return nil
+	}
+	parts, ok := AsArray(arg)
+	if !ok || len(parts) != 2 {
+		return errors.New("expected a number or a [skip, limit] array")
+	}
+	if _, err := integerModifier("$slice skip", parts[0]); err != nil {
+		return err
+	}
+	limit, err := integerModifier("$slice limit", parts[1])
+	if err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return errors.New("the limit must be positive")
+	}
+	return nil
+}
+
+// Apply returns the projected copy of doc. filter is the query that matched
+// doc, which a positional projection refers to.
+func (p *Projection) Apply(doc Document, filter Document) (Document, error) {
+	var result map[string]interface{}
+	if p.inclusion {
+		result = make(map[string]interface{})
+		if id, ok := doc["_id"]; ok && !p.excludeID {
+			result["_id"] = CopyValue(id)
+		}
+		for key, child := range p.fields.children {
+			if value, ok := doc[key]; ok {
+				if projected, ok := includeValue(value, child); ok {
+					result[key] = projected
+				}
+			}
+		}
+	} else {
+		result = excludeValue(map[string]interface{}(doc), p.fields).(map[string]interface{})
+		if p.excludeID {
+			delete(result, "_id")
+		}
+	}
+	for path, arg := range p.slices {
+		if value, ok := LookupPath(result, path); ok {
+			if elements, ok := AsArray(value); ok {
+				if err := SetPath(result, path, sliceElements(elements, arg)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for field, criteria := range p.elemMatches {
+		delete(result, field)
+		elements, _ := AsArray(doc[field])
+		for _, elem := range elements {
+			matched, err := MatchesFilter(Document{field: []interface{}{elem}}, Document{field: Document{"$elemMatch": criteria}})
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				result[field] = []interface{}{CopyValue(elem)}
+				break
+			}
+		}
+	}
+	if p.positional != "" {
+		if value, ok := LookupPath(doc, p.positional); ok {
+			if elements, ok := AsArray(value); ok {
+				i, err := positionalIndex(doc, p.positional, elements, filter)
+				if err != nil {
+					return nil, fmt.Errorf("executor error during find command: %w", err)
+				}
+				if err := SetPath(result, p.positional, []interface{}{CopyValue(elements[i])}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return Document(result), nil
+}
+
+// includeValue keeps the parts of value that node selects. Inside arrays the
+// selection applies to each embedded document and other elements are
+// dropped; a scalar where a document was expected is left out.
+func includeValue(value interface{}, node *projectionNode) (interface{}, bool) {
+	if node.leaf() {
+		return CopyValue(value), true
+	}
+	if d, ok := AsDocument(value); ok {
+		result := make(map[string]interface{})
+		for key, child := range node.children {
+			if v, ok := d[key]; ok {
+				if projected, ok := includeValue(v, child); ok {
+					result[key] = projected
+				}
+			}
+		}
+		return result, true
+	}
+	if elements, ok := AsArray(value); ok {
+		result := make([]interface{}, 0, len(elements))
+		for _, elem := range elements {
+			if _, isDoc := AsDocument(elem); !isDoc {
+				if _, isArray := AsArray(elem); !isArray {
+					continue
+				}
+			}
+			if projected, ok := includeValue(elem, node); ok {
+				result = append(result, projected)
+			}
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// excludeValue returns a copy of value without the parts node selects.
+func excludeValue(value interface{}, node *projectionNode) interface{} {
+	if d, ok := AsDocument(value); ok {
+		result := make(map[string]interface{}, len(d))
+		for key, v := range d {
+			child, selected := node.children[key]
+			switch {
+			case !selected:
+				result[key] = CopyValue(v)
+			case !child.leaf():
+				result[key] = excludeValue(v, child)
+			}
+		}
+		return result
+	}
+	if elements, ok := AsArray(value); ok {
+		result := make([]interface{}, len(elements))
+		for i, elem := range elements {
+			result[i] = excludeValue(elem, node)
+		}
+		return result
+	}
+	return CopyValue(value)
+}
+
+// sliceElements implements the $slice projection: n keeps the first n
+// elements, -n the last n, and [skip, n] n elements after skipping skip,
+// counted from the end when skip is negative.
+func sliceElements(elements []interface{}, arg interface{}) []interface{} {
+	skip, limit := 0, 0
+	if n, err := integerModifier("$slice", arg); err == nil {
+		if n >= 0 {
+			limit = n
+		} else {
+			skip, limit = n, -n
+		}
+	} else {
+		parts, _ := AsArray(arg)
+		skip, _ = integerModifier("$slice", parts[0])
+		limit, _ = integerModifier("$slice", parts[1])
+	}
+	if skip < 0 {
+		skip += len(elements)
+		if skip < 0 {
+			skip = 0
+		}
+	}
+	if skip > len(elements) {
+		skip = len(elements)
+	}
+	end := skip + limit
+	if end > len(elements) {
+		end = len(elements)
+	}
+	return CopyValue(elements[skip:end]).([]interface{})
+}
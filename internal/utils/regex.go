@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// regexCache holds compiled expressions keyed by pattern and options, since
+// the same filter is evaluated once per document.
+var regexCache sync.Map
+
+// isRegex reports whether v is a regular expression value usable as a filter.
+func isRegex(v interface{}) bool {
+	switch v.(type) {
+	case primitive.Regex, *regexp.Regexp:
+		return true
+	}
+	return false
+}
+
+// compileRegex turns a $regex operand into a Go expression. The operand may
+// be a string, a primitive.Regex or a *regexp.Regexp; options from a sibling
+// $options field are added to any the primitive.Regex already carries.
+func compileRegex(pattern interface{}, options string) (*regexp.Regexp, error) {
+	switch p := pattern.(type) {
+	case *regexp.Regexp:
+		if options == "" {
+			return p, nil
+		}
+		return buildRegex(p.String(), options)
+	case primitive.Regex:
+		return buildRegex(p.Pattern, p.Options+options)
+	case string:
+		return buildRegex(p, options)
+	}
+	return nil, errors.New("$regex has to be a string")
+}
+
+func buildRegex(pattern, options string) (*regexp.Regexp, error) {
+	key := options + "/" + pattern
+	if cached, ok := regexCache.Load(key); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	flags := ""
+	for _, option := range options {
+		switch option {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(flags, option) {
+				flags += string(option)
+			}
+		case 'x':
+			pattern = stripExtended(pattern)
+		case 'u':
+			// Patterns are always matched as UTF-8.
+		default:
+			return nil, fmt.Errorf("invalid flag in regex options: %c", option)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %w", err)
+	}
+	regexCache.Store(key, re)
+	return re, nil
+}
+
+// stripExtended implements the "x" option, which Go's regexp lacks, by
+// dropping unescaped whitespace and #-comments outside character classes.
+func stripExtended(pattern string) string {
+	var b strings.Builder
+	inClass, inComment := false, false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case inComment:
+			inComment = c != '\n'
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			b.WriteByte(pattern[i+1])
+			i++
+		case inClass:
+			inClass = c != ']'
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		case c == '#':
+			inComment = true
+		case c == ' ', c == '\t', c == '\n', c == '\r', c == '\f', c == '\v':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// matchRegex reports whether docValue is a string or symbol matching re, or a
+// stored regular expression identical to the one in the filter.
+func matchRegex(docValue interface{}, re *regexp.Regexp) bool {
+	switch v := docValue.(type) {
+	case string:
+		return re.MatchString(v)
+	case primitive.Symbol:
+		return re.MatchString(string(v))
+	case primitive.Regex, *regexp.Regexp:
+		pattern, _ := regexParts(v)
+		return pattern == re.String()
+	}
+	return false
+}
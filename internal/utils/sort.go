@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SortKey is one field of a sort specification.
+type SortKey struct {
+	Path       string
+	Descending bool
+}
+
+// ParseSortSpec converts a sort specification such as {"age": -1} into sort
+// keys. Go maps have no order, so a specification with several keys must be
+// a bson.D.
+func ParseSortSpec(spec interface{}) ([]SortKey, error) {
+	var elements primitive.D
+	if d, ok := spec.(primitive.D); ok {
+		elements = d
+	} else if m, ok := AsDocument(spec); ok {
+		if len(m) > 1 {
+			return nil, errors.New("a sort specification with several keys must be an ordered document such as bson.D")
+		}
+		for key, value := range m {
+			elements = append(elements, primitive.E{Key: key, Value: value})
+		}
+	} else {
+		return nil, errors.New("sort specification must be a document")
+	}
+	keys := make([]SortKey, 0, len(elements))
+	for _, e := range elements {
+		direction, ok := toFloat(e.Value)
+		if !ok || (direction != 1 && direction != -1) {
+			return nil, fmt.Errorf("sort direction for '%s' must be 1 or -1, got %v", e.Key, e.Value)
+		}
+		keys = append(keys, SortKey{Path: e.Key, Descending: direction == -1})
+	}
+	return keys, nil
+}
+
+// CompareBySortKeys orders two documents by the given keys.
+func CompareBySortKeys(a, b map[string]interface{}, keys []SortKey) int {
+	for _, key := range keys {
+		c := CompareValues(sortValue(a, key), sortValue(b, key))
+		if key.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// SortDocuments stably sorts docs by the given keys.
+func SortDocuments(docs []map[string]interface{}, keys []SortKey) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		return CompareBySortKeys(docs[i], docs[j], keys) < 0
+	})
+}
+
+// sortValue picks the value a document sorts by. When a path reaches an array
+// the smallest element is used for ascending sorts and the largest for
+// descending ones; a missing path sorts as null.
+func sortValue(doc map[string]interface{}, key SortKey) interface{} {
+	var candidates []interface{}
+	for _, value := range ResolvePath(doc, key.Path) {
+		if elements, ok := AsArray(value); ok {
+			candidates = append(candidates, elements...)
+		} else {
+			candidates = append(candidates, value)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		c := CompareValues(candidate, best)
+		if (key.Descending && c > 0) || (!key.Descending && c < 0) {
+			best = candidate
+		}
+	}
+	return best
+}
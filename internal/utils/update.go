@@ -0,0 +1,370 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UpdateContext carries what an update needs beyond the document itself.
+type UpdateContext struct {
+	// Now is the time written by $currentDate. The zero value means time.Now.
+	Now time.Time
+	// Filter is the query that selected the document. The positional $
+	// operator refers to the array element it matched.
+	Filter Document
+	// ArrayFilters holds the conditions for $[identifier] path segments.
+	ArrayFilters []interface{}
+	// Inserting is set when the update builds an upserted document, which is
+	// the only time $setOnInsert applies.
+	Inserting bool
+}
+
+func (ctx *UpdateContext) now() time.Time {
+	if ctx == nil || ctx.Now.IsZero() {
+		return time.Now()
+	}
+	return ctx.Now
+}
+
+// updateOperators lists the supported update operators in the order they are
+// applied, which keeps results independent of map iteration order.
+var updateOperators = []string{
+	"$currentDate",
+	"$inc",
+	"$max",
+	"$min",
+	"$mul",
+	"$rename",
+	"$set",
+	"$setOnInsert",
+	"$unset",
+	"$addToSet",
+	"$pop",
+	"$pull",
+	"$pullAll",
+	"$push",
+}
+
+// IsOperatorUpdate reports whether update is made of update operators such as
+// $set, as opposed to a plain document of fields. Mixing both is an error.
+func IsOperatorUpdate(update Document) (bool, error) {
+	operators, fields := 0, 0
+	for key := range update {
+		if strings.HasPrefix(key, "$") {
+			operators++
+		} else {
+			fields++
+		}
+	}
+	if operators > 0 && fields > 0 {
+		return false, errors.New("update document cannot mix update operators and plain fields")
+	}
+	return operators > 0, nil
+}
+
+// ApplyUpdate applies update to a copy of doc and returns the copy along with
+// whether anything changed. An update made of operators is applied operator
+// by operator, with positional path segments resolved against ctx; a plain
+// document is merged into doc field by field. doc is left untouched when an
+// error is returned.
+func ApplyUpdate(doc Document, update Document, ctx *UpdateContext) (Document, bool, error) {
+	if len(update) == 0 {
+		return nil, false, errors.New("update document must not be empty")
+	}
+	isOperatorUpdate, err := IsOperatorUpdate(update)
+	if err != nil {
+		return nil, false, err
+	}
+	updated := Document(CopyValue(map[string]interface{}(doc)).(map[string]interface{}))
+	if !isOperatorUpdate {
+		for key, value := range update {
+			if err := SetPath(updated, key, CopyValue(value)); err != nil {
+				return nil, false, err
+			}
+		}
+		return finishUpdate(doc, updated)
+	}
+	if err := checkUpdatePaths(update); err != nil {
+		return nil, false, err
+	}
+	var arrayFilters []interface{}
+	if ctx != nil {
+		arrayFilters = ctx.ArrayFilters
+	}
+	filters, err := parseArrayFilters(arrayFilters)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkArrayFilterUse(update, filters); err != nil {
+		return nil, false, err
+	}
+	for _, operator := range updateOperators {
+		operand, ok := update[operator]
+		if !ok {
+			continue
+		}
+		fields, ok := AsDocument(operand)
+		if !ok {
+			return nil, false, fmt.Errorf("modifiers for %s must be an object", operator)
+		}
+		for _, path := range sortedKeys(fields) {
+			if operator == "$rename" && hasPositional(path) {
+				return nil, false, fmt.Errorf("the source field for $rename may not be dynamic: %s", path)
+			}
+			paths, err := expandPath(updated, path, ctx, filters)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, concrete := range paths {
+				if err := applyOperator(updated, operator, concrete, fields[path], ctx); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+	}
+	return finishUpdate(doc, updated)
+}
+
+// finishUpdate checks that the update kept the document's _id, which is
+// immutable once set, and reports whether anything changed. The updated
+// document keeps the _id exactly as it was.
+func finishUpdate(before, after Document) (Document, bool, error) {
+	if id, ok := before["_id"]; ok {
+		if newID, ok := after["_id"]; !ok || !EqualValues(id, newID) {
+			return nil, false, errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+		}
+		after["_id"] = id
+	}
+	return after, changed(before, after), nil
+}
+
+// changed reports whether an update really changed the document. Both are
+// compared as copies, so only values count and not the Go types holding
+// embedded documents and arrays.
+func changed(before, after Document) bool {
+	return !reflect.DeepEqual(CopyValue(map[string]interface{}(before)), CopyValue(map[string]interface{}(after)))
+}
+
+// checkUpdatePaths rejects unknown operators and updates that touch the same
+// path, or a path and one of its parents, more than once.
+func checkUpdatePaths(update Document) error {
+	var paths []string
+	for operator, operand := range update {
+		if !isUpdateOperator(operator) {
+			return fmt.Errorf("unknown modifier: %s", operator)
+		}
+		fields, _ := AsDocument(operand)
+		for path, value := range fields {
+			if path == "" {
+				return fmt.Errorf("an empty update path is not valid for %s", operator)
+			}
+			paths = append(paths, path)
+			if operator == "$rename" {
+				if target, ok := value.(string); ok {
+					paths = append(paths, target)
+				}
+			}
+		}
+	}
+	sort.Strings(paths)
+	for i := 1; i < len(paths); i++ {
+		if paths[i] == paths[i-1] || strings.HasPrefix(paths[i], paths[i-1]+".") {
+			return fmt.Errorf("updating the path '%s' would create a conflict at '%s'", paths[i], paths[i-1])
+		}
+	}
+	return nil
+}
+
+func isUpdateOperator(operator string) bool {
+	for _, known := range updateOperators {
+		if known == operator {
+			return true
+		}
+	}
+	return false
+}
+
+func applyOperator(doc Document, operator, path string, operand interface{}, ctx *UpdateContext) error {
+	current, exists := LookupPath(doc, path)
+	switch operator {
+	case "$push", "$addToSet", "$pull", "$pullAll", "$pop":
+		return applyArrayOperator(doc, operator, path, operand)
+	case "$set":
+		return SetPath(doc, path, CopyValue(operand))
+	case "$setOnInsert":
+		if ctx != nil && ctx.Inserting {
+			return SetPath(doc, path, CopyValue(operand))
+		}
+		return nil
+	case "$unset":
+		UnsetPath(doc, path)
+		return nil
+	case "$inc", "$mul":
+		if !IsNumber(operand) {
+			return fmt.Errorf("cannot %s with non-numeric argument: {%s: %v}", operator[1:], path, operand)
+		}
+		if exists && !IsNumber(current) {
+			return fmt.Errorf("cannot apply %s to a value of non-numeric type. {%s: %v} has the field '%s' of non-numeric type %s",
+				operator, path, current, path, BSONType(current))
+		}
+		var result interface{}
+		var err error
+		switch {
+		case operator == "$inc" && !exists:
+			result = operand
+		case operator == "$inc":
+			result, err = addNumbers(current, operand)
+		case !exists:
+			result = zeroLike(operand)
+		default:
+			result, err = multiplyNumbers(current, operand)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply %s operations to current value (%v) for document: %w", operator, current, err)
+		}
+		return SetPath(doc, path, result)
+	case "$min", "$max":
+		c := CompareValues(operand, current)
+		if !exists || (operator == "$min" && c < 0) || (operator == "$max" && c > 0) {
+			return SetPath(doc, path, CopyValue(operand))
+		}
+		return nil
+	case "$rename":
+		target, ok := operand.(string)
+		if !ok || target == "" {
+			return fmt.Errorf("the 'to' field for $rename must be a string: %s: %v", path, operand)
+		}
+		if !exists {
+			return nil
+		}
+		UnsetPath(doc, path)
+		return SetPath(doc, target, current)
+	case "$currentDate":
+		value, err := currentDate(operand, ctx.now())
+		if err != nil {
+			return fmt.Errorf("%s for field '%s': %w", operator, path, err)
+		}
+		return SetPath(doc, path, value)
+	}
+	return fmt.Errorf("unknown modifier: %s", operator)
+}
+
+// currentDate interprets a $currentDate operand, which is either true for a
+// date or a {"$type": "date" | "timestamp"} document.
+func currentDate(operand interface{}, now time.Time) (interface{}, error) {
+	if b, ok := operand.(bool); ok {
+		if !b {
+			return nil, errors.New("only true or a {$type: ...} document is supported")
+		}
+		return now, nil
+	}
+	spec, ok := AsDocument(operand)
+	if !ok || len(spec) != 1 {
+		return nil, errors.New("expected a boolean or a {$type: ...} document")
+	}
+	switch spec["$type"] {
+	case "date":
+		return now, nil
+	case "timestamp":
+		return primitive.Timestamp{T: uint32(now.Unix()), I: 1}, nil
+	}
+	return nil, errors.New("the '$type' string field is required to be 'date' or 'timestamp'")
+}
+
+// ReplaceDocument returns replacement as the new version of doc along with
+// whether anything changed. The replacement may not contain update
+// operators, and the document keeps its _id: a replacement naming a
+// different _id is an error.
+func ReplaceDocument(doc Document, replacement Document) (Document, bool, error) {
+	if err := ValidateReplacement(replacement); err != nil {
+		return nil, false, err
+	}
+	replaced := Document(CopyValue(map[string]interface{}(replacement)).(map[string]interface{}))
+	if id, ok := doc["_id"]; ok {
+		if newID, ok := replaced["_id"]; !ok || EqualValues(id, newID) {
+			replaced["_id"] = CopyValue(id)
+		}
+	}
+	return finishUpdate(doc, replaced)
+}
+
+// UpsertReplacement builds the document an upsert with a replacement
+// inserts. Unlike an operator update, only the _id of an equality condition
+// in filter is carried over, and only when the replacement has none. Like
+// any _id, it keeps the type it was given.
+func UpsertReplacement(filter Document, replacement Document) (Document, error) {
+	if err := ValidateReplacement(replacement); err != nil {
+		return nil, err
+	}
+	inserted := Document(CopyValue(map[string]interface{}(replacement)).(map[string]interface{}))
+	if _, ok := replacement["_id"]; !ok {
+		seed := Document{}
+		if err := addEqualityFields(seed, filter); err != nil {
+			return nil, err
+		}
+		if id, ok := seed["_id"]; ok {
+			inserted["_id"] = id
+		}
+	}
+	return inserted, nil
+}
+
+// ValidateReplacement rejects replacement documents containing update
+// operators, which would otherwise be stored as field names.
+func ValidateReplacement(replacement Document) error {
+	for key := range replacement {
+		if strings.HasPrefix(key, "$") {
+			return errors.New("replacement document cannot contain keys beginning with '$'")
+		}
+	}
+	return nil
+}
+
+// UpsertDocument builds the document an upsert inserts: the equality
+// conditions of filter, including those inside $and, with update applied on
+// top as an insert so that $setOnInsert takes effect. As on insert, the _id
+// keeps the type it has in filter.
+func UpsertDocument(filter Document, update Document, ctx *UpdateContext) (Document, error) {
+	seed := Document{}
+	if err := addEqualityFields(seed, filter); err != nil {
+		return nil, err
+	}
+	inserted, _, err := ApplyUpdate(seed, update, ctx)
+	return inserted, err
+}
+
+func addEqualityFields(seed Document, filter map[string]interface{}) error {
+	for key, value := range filter {
+		if key == "$and" {
+			clauses, _ := AsArray(value)
+			for _, clause := range clauses {
+				if sub, ok := AsDocument(clause); ok {
+					if err := addEqualityFields(seed, sub); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") || isRegex(value) {
+			continue
+		}
+		if operators, ok := operatorDocument(value); ok {
+			eq, hasEq := operators["$eq"]
+			if !hasEq {
+				continue
+			}
+			value = eq
+		}
+		if err := SetPath(seed, key, CopyValue(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// applyArrayOperator handles the update operators that modify arrays: $push,
+// $addToSet, $pull, $pullAll and $pop.
+func applyArrayOperator(doc Document, operator, path string, operand interface{}) error {
+	current, exists := LookupPath(doc, path)
+	var elements []interface{}
+	if exists {
+		var ok bool
+		elements, ok = AsArray(current)
+		if !ok {
+			return fmt.Errorf("the field '%s' must be an array but is of type %s", path, BSONType(current))
+		}
+	} else if operator != "$push" && operator != "$addToSet" {
+		// Removing from a missing array is a no-op.
+		return nil
+	}
+	var result []interface{}
+	var err error
+	switch operator {
+	case "$push":
+		result, err = push(elements, operand)
+	case "$addToSet":
+		result, err = addToSet(elements, operand)
+	case "$pull":
+		result, err = pull(elements, operand)
+	case "$pullAll":
+		result, err = pullAll(elements, operand)
+	case "$pop":
+		result, err = pop(elements, operand)
+	}
+	if err != nil {
+		return fmt.Errorf("%s for field '%s': %w", operator, path, err)
+	}
+	return SetPath(doc, path, result)
+}
+
+// eachOperand splits a $push or $addToSet operand into the values to add and
+// any modifiers. Without $each the operand itself is the single value.
+func eachOperand(operand interface{}, allowed ...string) ([]interface{}, map[string]interface{}, error) {
+	modifiers, ok := AsDocument(operand)
+	if !ok {
+		return []interface{}{CopyValue(operand)}, nil, nil
+	}
+	if _, hasEach := modifiers["$each"]; !hasEach {
+		for key := range modifiers {
+			if strings.HasPrefix(key, "$") {
+				return nil, nil, fmt.Errorf("unrecognized modifier %s without $each", key)
+			}
+		}
+		return []interface{}{CopyValue(operand)}, nil, nil
+	}
+	for key := range modifiers {
+		if key == "$each" {
+			continue
+		}
+		valid := false
+		for _, name := range allowed {
+			valid = valid || key == name
+		}
+		if !valid {
+			return nil, nil, fmt.Errorf("unrecognized clause in $each: %s", key)
+		}
+	}
+	values, ok := AsArray(modifiers["$each"])
+	if !ok {
+		return nil, nil, errors.New("the argument to $each must be an array")
+	}
+	return CopyValue(values).([]interface{}), modifiers, nil
+}
+
+// push appends values, honoring the $position, $sort and $slice modifiers in
+// that order.
+func push(elements []interface{}, operand interface{}) ([]interface{}, error) {
+	values, modifiers, err := eachOperand(operand, "$position", "$sort", "$slice")
+	if err != nil {
+		return nil, err
+	}
+	position := len(elements)
+	if p, ok := modifiers["$position"]; ok {
+		n, err := integerModifier("$position", p)
+		if err != nil {
+			return nil, err
+		}
+		position = clampIndex(n, len(elements))
+	}
+	result := make([]interface{}, 0, len(elements)+len(values))
+	result = append(result, elements[:position]...)
+	result = append(result, values...)
+	result = append(result, elements[position:]...)
+	if spec, ok := modifiers["$sort"]; ok {
+		if err := sortElements(result, spec); err != nil {
+			return nil, err
+		}
+	}
+	if s, ok := modifiers["$slice"]; ok {
+		n, err := integerModifier("$slice", s)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case n >= 0 && n < len(result):
+			result = result[:n]
+		case n < 0 && -n < len(result):
+			result = result[len(result)+n:]
+		}
+	}
+	return result, nil
+}
+
+func integerModifier(name string, v interface{}) (int, error) {
+	f, ok := toFloat(v)
+	if !ok || f != float64(int(f)) {
+		return 0, fmt.Errorf("the value for %s must be an integer, got %v", name, v)
+	}
+	return int(f), nil
+}
+
+// clampIndex turns a possibly negative insertion index into a valid one.
+func clampIndex(n, length int) int {
+	if n < 0 {
+		n += length
+		if n < 0 {
+			n = 0
+		}
+	}
+	if n > length {
+		n = length
+	}
+	return n
+}
+
+// sortElements implements the $sort modifier: 1 or -1 sorts elements by
+// value, while a document sorts embedded documents by the given fields.
+func sortElements(elements []interface{}, spec interface{}) error {
+	if direction, ok := toFloat(spec); ok {
+		if direction != 1 && direction != -1 {
+			return errors.New("the $sort element value must be either 1 or -1")
+		}
+		sort.SliceStable(elements, func(i, j int) bool {
+			return CompareValues(elements[i], elements[j])*int(direction) < 0
+		})
+		return nil
+	}
+	keys, err := ParseSortSpec(spec)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		a, _ := AsDocument(elements[i])
+		b, _ := AsDocument(elements[j])
+		return CompareBySortKeys(a, b, keys) < 0
+	})
+	return nil
+}
+
+// addToSet appends each value that is not already in the array.
+func addToSet(elements []interface{}, operand interface{}) ([]interface{}, error) {
+	values, _, err := eachOperand(operand)
+	if err != nil {
+		return nil, err
+	}
+	result := append([]interface{}{}, elements...)
+	for _, value := range values {
+		if !containsValue(result, value) {
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
+
+func containsValue(elements []interface{}, value interface{}) bool {
+	for _, elem := range elements {
+		if EqualValues(elem, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// pull removes every element matching the operand. The operand is evaluated
+// like an $elemMatch condition: an operator document such as {"$gte": 6} is
+// applied to each element, other documents are queries on embedded document
+// elements, and anything else is compared for equality.
+func pull(elements []interface{}, operand interface{}) ([]interface{}, error) {
+	criteria, isDoc := AsDocument(operand)
+	valueForm := isDoc && isValueCondition(criteria)
+	result := make([]interface{}, 0, len(elements))
+	for _, elem := range elements {
+		var matched bool
+		var err error
+		if isDoc {
+			matched, err = matchElement(elem, criteria, valueForm)
+		} else if isRegex(operand) {
+			var re *regexp.Regexp
+			if re, err = compileRegex(operand, ""); err == nil {
+				matched = matchRegex(elem, re)
+			}
+		} else {
+			matched = EqualValues(elem, operand)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			result = append(result, elem)
+		}
+	}
+	return result, nil
+}
+
+// pullAll removes every element equal to one of the listed values.
+func pullAll(elements []interface{}, operand interface{}) ([]interface{}, error) {
+	values, ok := AsArray(operand)
+	if !ok {
+		return nil, errors.New("$pullAll requires an array argument")
+	}
+	result := make([]interface{}, 0, len(elements))
+	for _, elem := range elements {
+		if !containsValue(values, elem) {
+			result = append(result, elem)
+		}
+	}
+	return result, nil
+}
+
+// pop removes the last element for 1 and the first for -1.
+func pop(elements []interface{}, operand interface{}) ([]interface{}, error) {
+	direction, ok := toFloat(operand)
+	if !ok || (direction != 1 && direction != -1) {
+		return nil, fmt.Errorf("$pop expects 1 or -1, found: %v", operand)
+	}
+	if len(elements) == 0 {
+		return elements, nil
+	}
+	if direction == 1 {
+		return append([]interface{}{}, elements[:len(elements)-1]...), nil
+	}
+	return append([]interface{}{}, elements[1:]...), nil
+}
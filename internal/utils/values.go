@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var plainMapType = reflect.TypeOf(map[string]interface{}{})
+
+// AsDocument returns v as a plain map when it is any kind of string-keyed map,
+// such as Document, map[string]interface{}, bson.M or bson.D.
+func AsDocument(v interface{}) (map[string]interface{}, bool) {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d, true
+	case Document:
+		return d, true
+	case primitive.D:
+		result := make(map[string]interface{}, len(d))
+		for _, e := range d {
+			result[e.Key] = e.Value
+		}
+		return result, true
+	case nil:
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	// Named map types such as bson.M share their storage with the result.
+	if rv.Type().ConvertibleTo(plainMapType) {
+		return rv.Convert(plainMapType).Interface().(map[string]interface{}), true
+	}
+	result := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		result[iter.Key().String()] = iter.Value().Interface()
+	}
+	return result, true
+}
+
+// AsArray returns v as a []interface{} when it is a slice or array of any
+// element type. Byte slices and byte arrays such as ObjectIDs are scalar
+// values rather than arrays.
+func AsArray(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case []interface{}:
+		return a, true
+	case []byte, primitive.D, nil:
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	if rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	result := make([]interface{}, rv.Len())
+	for i := range result {
+		result[i] = rv.Index(i).Interface()
+	}
+	return result, true
+}
+
+// bsonTypeCodes maps the $type aliases to their numeric BSON type codes.
+var bsonTypeCodes = map[string]int{
+	"double":              1,
+	"string":              2,
+	"object":              3,
+	"array":               4,
+	"binData":             5,
+	"undefined":           6,
+	"objectId":            7,
+	"bool":                8,
+	"date":                9,
+	"null":                10,
+	"regex":               11,
+	"dbPointer":           12,
+	"javascript":          13,
+	"symbol":              14,
+	"javascriptWithScope": 15,
+	"int":                 16,
+	"timestamp":           17,
+	"long":                18,
+	"decimal":             19,
+	"minKey":              -1,
+	"maxKey":              127,
+}
+
+// BSONType returns the $type alias a value would be stored as. Go integers
+// follow the driver's encoding: int32 when they fit, int64 otherwise.
+func BSONType(v interface{}) string {
+	switch t := v.(type) {
+	case nil, primitive.Null:
+		return "null"
+	case float64, float32:
+		return "double"
+	case string:
+		return "string"
+	case int8, int16, int32, uint8, uint16:
+		return "int"
+	case int:
+		if t >= math.MinInt32 && t <= math.MaxInt32 {
+			return "int"
+		}
+		return "long"
+	case int64, uint, uint32, uint64:
+		return "long"
+	case bool:
+		return "bool"
+	case time.Time, primitive.DateTime:
+		return "date"
+	case primitive.ObjectID:
+		return "objectId"
+	case []byte, primitive.Binary:
+		return "binData"
+	case primitive.Undefined:
+		return "undefined"
+	case primitive.Regex, *regexp.Regexp:
+		return "regex"
+	case primitive.DBPointer:
+		return "dbPointer"
+	case primitive.JavaScript:
+		return "javascript"
+	case primitive.Symbol:
+		return "symbol"
+	case primitive.CodeWithScope:
+		return "javascriptWithScope"
+	case primitive.Timestamp:
+		return "timestamp"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.MinKey:
+		return "minKey"
+	case primitive.MaxKey:
+		return "maxKey"
+	}
+	if _, ok := AsDocument(v); ok {
+		return "object"
+	}
+	if _, ok := AsArray(v); ok {
+		return "array"
+	}
+	return "object"
+}
+
+// toFloat converts any Go numeric value to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// CopyValue returns a deep copy of v. Embedded documents become
+// map[string]interface{} and arrays []interface{}; scalars are kept as is.
+func CopyValue(v interface{}) interface{} {
+	if isRegex(v) || BSONType(v) == "binData" {
+		return v
+	}
+	if d, ok := AsDocument(v); ok {
+		result := make(map[string]interface{}, len(d))
+		for key, value := range d {
+			result[key] = CopyValue(value)
+		}
+		return result
+	}
+	if arr, ok := AsArray(v); ok {
+		result := make([]interface{}, len(arr))
+		for i, value := range arr {
+			result[i] = CopyValue(value)
+		}
+		return result
+	}
+	return v
+}
@@ -0,0 +1,271 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kylejryan/mocument/internal/utils"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// aggregationStage transforms the documents flowing through a pipeline.
+type aggregationStage func(docs []utils.Document) ([]utils.Document, error)
+
+// Aggregate runs pipeline, a mongo.Pipeline or any array of single-stage
+// documents, against collection and returns a cursor over the results, like
+// the driver's Collection.Aggregate. The batchSize option sets the size of
+// the cursor's batches. A leading $match stage is answered from an index
+// when one applies, and $lookup stages join with the other collections of m.
+func (m *MockDocDB) Aggregate(ctx context.Context, collection string, pipeline interface{}, opts ...*options.AggregateOptions) (*Cursor, error) {
+	if m.mockConfig.ErrorMode {
+		return nil, errors.New("simulated error")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	batchSize := mergeAggregateOptions(opts)
+	if batchSize < 0 {
+		return nil, errors.New("batch size must be non-negative")
+	}
+	docs, err := m.runPipeline(collection, pipeline, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Document, len(docs))
+	for i, doc := range docs {
+		results[i] = Document(doc)
+	}
+	return newCursor(results, batchSize)
+}
+
+// runPipeline returns the documents pipeline produces from collection, with
+// vars available to its expressions. Callers must hold m.lock.
+func (m *MockDocDB) runPipeline(collection string, pipeline interface{}, vars utils.Variables) ([]utils.Document, error) {
+	specs, stages, err := m.parsePipeline(pipeline, vars)
+	if err != nil {
+		return nil, err
+	}
+	var positions []int
+	// The index can only answer a leading $match that needs no variables.
+	if len(stages) > 0 && specs[0]["$match"] != nil && len(vars) == 0 {
+		filter, _ := utils.AsDocument(specs[0]["$match"])
+		if positions, _, err = m.matchDocuments(collection, filter); err != nil {
+			return nil, err
+		}
+		stages = stages[1:]
+	} else {
+		positions = make([]int, len(m.documents[collection]))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+	docs := make([]utils.Document, len(positions))
+	for i, pos := range positions {
+		docs[i] = utils.Document(utils.CopyValue(map[string]interface{}(m.documents[collection][pos])).(map[string]interface{}))
+	}
+	for _, stage := range stages {
+		if docs, err = stage(docs); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// parsePipeline validates every stage of pipeline, returning their
+// specifications along with the functions that run them.
+func (m *MockDocDB) parsePipeline(pipeline interface{}, vars utils.Variables) ([]map[string]interface{}, []aggregationStage, error) {
+	specs, ok := utils.AsArray(pipeline)
+	if !ok {
+		return nil, nil, errors.New("pipeline must be an array of stages")
+	}
+	stages := make([]map[string]interface{}, len(specs))
+	runs := make([]aggregationStage, len(specs))
+	for i, spec := range specs {
+		stage, ok := utils.AsDocument(spec)
+		if !ok || len(stage) != 1 {
+			return nil, nil, errors.New("a pipeline stage specification object must contain exactly one field")
+		}
+		for name, value := range stage {
+			var err error
+			if runs[i], err = m.parseStage(name, value, vars); err != nil {
+				return nil, nil, err
+			}
+		}
+		stages[i] = stage
+	}
+	return stages, runs, nil
+}
+
+// parseStage validates a pipeline stage and returns the function that runs
+// it.
+func (m *MockDocDB) parseStage(name string, spec interface{}, vars utils.Variables) (aggregationStage, error) {
+	switch name {
+	case "$match":
+		filter, ok := utils.AsDocument(spec)
+		if !ok {
+			return nil, errors.New("the $match filter must be an object")
+		}
+		return func(docs []utils.Document) ([]utils.Document, error) {
+			var results []utils.Document
+			for _, doc := range docs {
+				matched, err := utils.MatchesFilterWithVariables(doc, filter, vars)
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					results = append(results, doc)
+				}
+			}
+			return results, nil
+		}, nil
+	case "$project":
+		project, err := utils.ParseProjectStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		return eachDocument(func(doc utils.Document) (utils.Document, error) {
+			return project.Apply(doc, vars)
+		}), nil
+	case "$addFields", "$set":
+		addFields, err := utils.ParseAddFieldsStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		return eachDocument(func(doc utils.Document) (utils.Document, error) {
+			return addFields.Apply(doc, vars)
+		}), nil
+	case "$unset":
+		projection, err := utils.ParseUnsetStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		return eachDocument(func(doc utils.Document) (utils.Document, error) {
+			return projection.Apply(doc, nil)
+		}), nil
+	case "$sort":
+		keys, err := utils.ParseSortSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, errors.New("$sort stage must have at least one sort key")
+		}
+		return func(docs []utils.Document) ([]utils.Document, error) {
+			sorted := append([]utils.Document(nil), docs...)
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return utils.CompareBySortKeys(sorted[i], sorted[j], keys) < 0
+			})
+			return sorted, nil
+		}, nil
+	case "$skip", "$limit":
+		n, err := utils.ParseSkipOrLimit(name, spec)
+		if err != nil {
+			return nil, err
+		}
+		return func(docs []utils.Document) ([]utils.Document, error) {
+			if name == "$skip" {
+				if n >= len(docs) {
+					return nil, nil
+				}
+				return docs[n:], nil
+			}
+			if n < len(docs) {
+				return docs[:n], nil
+			}
+			return docs, nil
+		}, nil
+	case "$count":
+		field, ok := spec.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, errors.New("the count field must be a non-empty string that does not start with '$' or contain '.'")
+		}
+		return func(docs []utils.Document) ([]utils.Document, error) {
+			if len(docs) == 0 {
+				return nil, nil
+			}
+			return []utils.Document{{field: int32(len(docs))}}, nil
+		}, nil
+	case "$unwind":
+		unwind, err := utils.ParseUnwindStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		return func(docs []utils.Document) ([]utils.Document, error) {
+			var results []utils.Document
+			for _, doc := range docs {
+				unwound, err := unwind.Apply(doc)
+				if err != nil {
+					return nil, err
+				}
+				results = append(results, unwound...)
+			}
+			return results, nil
+		}, nil
+	case "$group":
+		group, err := utils.ParseGroupStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		return func(docs []utils.Document) ([]utils.Document, error) {
+			return group.Apply(docs, vars)
+		}, nil
+	case "$lookup":
+		lookup, err := utils.ParseLookupStage(spec)
+		if err != nil {
+			return nil, err
+		}
+		fields, _ := utils.AsDocument(spec)
+		if pipeline, ok := fields["pipeline"]; ok {
+			if _, _, err := m.parsePipeline(pipeline, vars); err != nil {
+				return nil, err
+			}
+		}
+		return eachDocument(func(doc utils.Document) (utils.Document, error) {
+			pipeline, joinVars, err := lookup.Pipeline(doc, vars)
+			if err != nil {
+				return nil, err
+			}
+			joined, err := m.runPipeline(lookup.From(), pipeline, joinVars)
+			if err != nil {
+				return nil, err
+			}
+			return lookup.Join(doc, joined)
+		}), nil
+	case "$replaceRoot", "$replaceWith":
+		newRoot := spec
+		if name == "$replaceRoot" {
+			fields, ok := utils.AsDocument(spec)
+			if !ok || len(fields) != 1 || fields["newRoot"] == nil {
+				return nil, errors.New("$replaceRoot requires a document with a single newRoot field")
+			}
+			newRoot = fields["newRoot"]
+		}
+		return eachDocument(func(doc utils.Document) (utils.Document, error) {
+			return utils.ReplaceRoot(doc, newRoot, vars)
+		}), nil
+	}
+	return nil, fmt.Errorf("unrecognized pipeline stage name: '%s'", name)
+}
+
+// eachDocument makes a stage that transforms documents one at a time.
+func eachDocument(transform func(utils.Document) (utils.Document, error)) aggregationStage {
+	return func(docs []utils.Document) ([]utils.Document, error) {
+		results := make([]utils.Document, len(docs))
+		for i, doc := range docs {
+			var err error
+			if results[i], err = transform(doc); err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	}
+}
@@ -12,15 +12,27 @@ type MockConfig struct {
 	SimulateLatency bool
 	LatencyMs       int
 	ErrorMode       bool
+	// Clock supplies the current time for TTL expiry and $currentDate. It
+	// defaults to the system clock; use a MockClock to control time in tests.
+	Clock Clock
 }
 
 type Document map[string]interface{}
 
 type MockDocDB struct {
-	clusters   map[string]*docdb.CreateDBClusterInput
-	instances  map[string]*docdb.CreateDBInstanceInput
-	documents  map[string][]Document
-	lock       sync.RWMutex
+	clusters  map[string]*docdb.CreateDBClusterInput
+	instances map[string]*docdb.CreateDBInstanceInput
+	documents map[string][]Document
+	// rows holds the row id of each document, in the same order as
+	// documents. Index entries refer to documents by row id, which unlike a
+	// position stays the same when earlier documents are deleted.
+	rows    map[string][]uint64
+	nextRow uint64
+	indexes map[string][]*index
+	lock    sync.RWMutex
+	// indexLock guards the index data that queries build while holding only
+	// a read lock.
+	indexLock  sync.Mutex
 	mockConfig *MockConfig
 }
 
@@ -29,6 +41,8 @@ func NewMockDocDB(config *MockConfig) *MockDocDB {
 		clusters:   make(map[string]*docdb.CreateDBClusterInput),
 		instances:  make(map[string]*docdb.CreateDBInstanceInput),
 		documents:  make(map[string][]Document),
+		rows:       make(map[string][]uint64),
+		indexes:    make(map[string][]*index),
 		mockConfig: config,
 	}
 }
@@ -1,12 +1,17 @@
 package mock
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/kylejryan/mocument/internal/utils"
 	"github.com/kylejryan/mocument/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
@@ -14,102 +19,215 @@ func init() {
 	logger.Init()
 }
 
-func (m *MockDocDB) InsertDocument(collection string, document Document) error {
+// InsertDocument stores a copy of document in collection, generating an
+// ObjectID _id when the document has none. The result carries the _id.
+func (m *MockDocDB) InsertDocument(collection string, document Document) (*mongo.InsertOneResult, error) {
 	if m.mockConfig.ErrorMode {
-		return errors.New("simulated error")
+		return nil, errors.New("simulated error")
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
-	m.documents[collection] = append(m.documents[collection], document)
-	return nil
+	stored := storedDocument(document)
+	if writeErr := m.appendDocument(collection, stored); writeErr != nil {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{*writeErr}}
+	}
+	return &mongo.InsertOneResult{InsertedID: stored["_id"]}, nil
 }
 
-func (m *MockDocDB) InsertMany(collection string, documents []interface{}) error {
+// InsertMany stores a copy of each of documents in collection, generating
+// ObjectID _ids where missing. Documents that would duplicate a unique index
+// key are reported in a mongo.WriteException by their position in documents;
+// an ordered insert, the default, stops at the first of them. The result
+// lists the _ids of the inserted documents in order.
+func (m *MockDocDB) InsertMany(collection string, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
 	if m.mockConfig.ErrorMode {
-		return errors.New("simulated error")
+		return nil, errors.New("simulated error")
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
+	ordered := mergeInsertManyOptions(opts)
 	docSlice := make([]Document, len(documents))
 	for i, doc := range documents {
-		docSlice[i] = doc.(Document)
+		docMap, ok := utils.AsDocument(doc)
+		if !ok {
+			return nil, fmt.Errorf("document %d is not a document: %v", i, doc)
+		}
+		docSlice[i] = storedDocument(docMap)
 	}
-	m.documents[collection] = append(m.documents[collection], docSlice...)
-	return nil
+	result := &mongo.InsertManyResult{}
+	var writeErrors mongo.WriteErrors
+	for i, doc := range docSlice {
+		if writeErr := m.appendDocument(collection, doc); writeErr != nil {
+			writeErr.Index = i
+			writeErrors = append(writeErrors, *writeErr)
+			if ordered {
+				break
+			}
+			continue
+		}
+		result.InsertedIDs = append(result.InsertedIDs, doc["_id"])
+	}
+	if len(writeErrors) > 0 {
+		return result, mongo.WriteException{WriteErrors: writeErrors}
+	}
+	return result, nil
+}
+
+// UpdateMany applies update to every document matching filter. The
+// arrayFilters option supplies the conditions for $[identifier] paths, and
+// with upsert set a document is inserted when nothing matches.
+func (m *MockDocDB) UpdateMany(collection string, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return m.update(collection, filter, update, true, mergeUpdateOptions(opts))
+}
+
+// UpdateOne applies update to the first document matching filter. The
+// arrayFilters option supplies the conditions for $[identifier] paths, and
+// with upsert set a document is inserted when nothing matches.
+func (m *MockDocDB) UpdateOne(collection string, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return m.update(collection, filter, update, false, mergeUpdateOptions(opts))
 }
 
-func (m *MockDocDB) UpdateMany(collection string, filter, update interface{}) error {
+// ReplaceOne replaces the first document matching filter with replacement,
+// keeping the document's _id. The replacement may not contain update
+// operators, and with upsert set it is inserted when nothing matches, taking
+// its _id from an equality condition on _id in filter if it has none.
+func (m *MockDocDB) ReplaceOne(collection string, filter, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
 	if m.mockConfig.ErrorMode {
-		return errors.New("simulated error")
+		return nil, errors.New("simulated error")
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
-	if documents, ok := m.documents[collection]; ok {
-		for i, doc := range documents {
-			if filterMap, ok := filter.(map[string]interface{}); ok {
-				match := true
-				for key, value := range filterMap {
-					if doc[key] != value {
-						match = false
-						break
-					}
-				}
-				if match {
-					for k, v := range update.(map[string]interface{}) {
-						doc[k] = v
-					}
-					documents[i] = doc
-				}
-			}
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	replacementMap, ok := utils.AsDocument(replacement)
+	if !ok {
+		return nil, errors.New("invalid replacement format")
+	}
+	if err := utils.ValidateReplacement(replacementMap); err != nil {
+		return nil, err
+	}
+	positions, _, err := m.matchDocuments(collection, filterMap)
+	if err != nil {
+		return nil, err
+	}
+	if len(positions) > 1 {
+		positions = positions[:1]
+	}
+	change := func(doc utils.Document) (utils.Document, bool, error) {
+		return utils.ReplaceDocument(doc, replacementMap)
+	}
+	var insert func() (utils.Document, error)
+	if mergeReplaceOptions(opts) {
+		insert = func() (utils.Document, error) {
+			return utils.UpsertReplacement(filterMap, replacementMap)
 		}
-		return nil
 	}
-	return errors.New("document not found")
+	result, _, err := m.changeDocuments(collection, positions, change, insert)
+	return result, err
 }
 
-func (m *MockDocDB) UpdateOne(collection string, filter, update interface{}) error {
+func (m *MockDocDB) update(collection string, filter, update interface{}, multi bool, settings updateSettings) (*mongo.UpdateResult, error) {
 	if m.mockConfig.ErrorMode {
-		return errors.New("simulated error")
+		return nil, errors.New("simulated error")
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
-	if documents, ok := m.documents[collection]; ok {
-		for i, doc := range documents {
-			match := true
-			if filterMap, ok := filter.(map[string]interface{}); ok {
-				for key, value := range filterMap {
-					if doc[key] != value {
-						match = false
-						break
-					}
-				}
-				if match {
-					for k, v := range update.(map[string]interface{}) {
-						doc[k] = v
-					}
-					documents[i] = doc
-					return nil
-				}
-			}
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	updateMap, ok := utils.AsDocument(update)
+	if !ok {
+		return nil, errors.New("invalid update format")
+	}
+	updateCtx := &utils.UpdateContext{Now: m.now(), Filter: filterMap, ArrayFilters: settings.arrayFilters}
+	positions, _, err := m.matchDocuments(collection, filterMap)
+	if err != nil {
+		return nil, err
+	}
+	if !multi && len(positions) > 1 {
+		positions = positions[:1]
+	}
+	change := func(doc utils.Document) (utils.Document, bool, error) {
+		return utils.ApplyUpdate(doc, updateMap, updateCtx)
+	}
+	var insert func() (utils.Document, error)
+	if settings.upsert {
+		insert = func() (utils.Document, error) {
+			updateCtx.Inserting = true
+			return utils.UpsertDocument(filterMap, updateMap, updateCtx)
 		}
-		return errors.New("document not found")
 	}
-	return errors.New("collection not found")
+	result, _, err := m.changeDocuments(collection, positions, change, insert)
+	return result, err
 }
 
-func (m *MockDocDB) FindDocument(collection string, filter Document) ([]Document, error) {
+// changeDocuments replaces the documents of collection at positions with
+// the result of change, or, when there are none and insert is set, inserts
+// the document insert builds, generating an ObjectID _id if it has none. It
+// returns the new version of the last document changed or inserted, and
+// leaves the collection untouched when an error is returned. Callers must
+// hold the write lock.
+func (m *MockDocDB) changeDocuments(collection string, positions []int, change func(utils.Document) (utils.Document, bool, error), insert func() (utils.Document, error)) (*mongo.UpdateResult, Document, error) {
+	result := &mongo.UpdateResult{}
+	documents := m.documents[collection]
+	var changedPositions []int
+	var changedDocuments []Document
+	var last Document
+	for _, pos := range positions {
+		updated, changed, err := change(utils.Document(documents[pos]))
+		if err != nil {
+			return nil, nil, err
+		}
+		result.MatchedCount++
+		last = documents[pos]
+		if changed {
+			last = Document(updated)
+			changedPositions = append(changedPositions, pos)
+			changedDocuments = append(changedDocuments, last)
+			result.ModifiedCount++
+		}
+	}
+	if len(positions) == 0 && insert != nil {
+		inserted, err := insert()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := inserted["_id"]; !ok {
+			inserted["_id"] = primitive.NewObjectID()
+		}
+		changedPositions = append(changedPositions, len(documents))
+		last = Document(inserted)
+		changedDocuments = append(changedDocuments, last)
+		result.UpsertedCount = 1
+		result.UpsertedID = inserted["_id"]
+	}
+	if len(changedPositions) > 0 {
+		if writeErr := m.writeDocuments(collection, changedPositions, changedDocuments); writeErr != nil {
+			return nil, nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{*writeErr}}
+		}
+	}
+	return result, last, nil
+}
+
+// FindDocument returns the documents of collection matching filter. The
+// sort, skip, limit and projection options are applied in that order; a
+// projection returns copies of the stored documents shaped by it.
+func (m *MockDocDB) FindDocument(collection string, filter Document, opts ...*options.FindOptions) ([]Document, error) {
 	if m.mockConfig.ErrorMode {
 		logger.Get().Debug("Simulated error in FindDocument", zap.String("collection", collection))
 		return nil, errors.New("simulated error")
@@ -120,57 +238,168 @@ func (m *MockDocDB) FindDocument(collection string, filter Document) ([]Document
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
-	documents, ok := m.documents[collection]
-	if !ok {
+	if _, ok := m.documents[collection]; !ok {
 		return nil, errors.New("collection not found")
 	}
+	return m.find(collection, utils.Document(filter), mergeFindOptions(opts))
+}
+
+// Find returns a cursor over the documents of collection matching filter,
+// like the driver's Collection.Find. It takes the same options as
+// FindDocument, and batchSize sets how many documents each batch of the
+// cursor holds. A missing collection yields an empty cursor.
+func (m *MockDocDB) Find(ctx context.Context, collection string, filter interface{}, opts ...*options.FindOptions) (*Cursor, error) {
+	if m.mockConfig.ErrorMode {
+		return nil, errors.New("simulated error")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	settings := mergeFindOptions(opts)
+	if settings.batchSize < 0 {
+		return nil, errors.New("batch size must be non-negative")
+	}
+	results, err := m.find(collection, filterMap, settings)
+	if err != nil {
+		return nil, err
+	}
+	return newCursor(results, settings.batchSize)
+}
+
+// find runs a query with its options. Callers must hold m.lock.
+func (m *MockDocDB) find(collection string, filter utils.Document, settings findSettings) ([]Document, error) {
+	if settings.skip < 0 {
+		return nil, errors.New("skip value must be non-negative")
+	}
+	var projection *utils.Projection
+	if settings.projection != nil {
+		var err error
+		if projection, err = utils.ParseProjection(settings.projection); err != nil {
+			return nil, err
+		}
+	}
+	positions, err := m.matchSorted(collection, filter, settings.sort)
+	if err != nil {
+		return nil, err
+	}
+	documents := m.documents[collection]
+	matched := make([]Document, len(positions))
+	for i, pos := range positions {
+		matched[i] = documents[pos]
+	}
+	if settings.skip >= int64(len(matched)) {
+		matched = nil
+	} else {
+		matched = matched[settings.skip:]
+	}
+	if settings.limit > 0 && settings.limit < int64(len(matched)) {
+		matched = matched[:settings.limit]
+	}
 	var results []Document
-	for _, doc := range documents {
-		if utils.MatchesFilter(utils.Document(doc), utils.Document(filter)) {
-			results = append(results, doc)
+	for _, doc := range matched {
+		if projection == nil {
+			results = append(results, Document(utils.CopyValue(map[string]interface{}(doc)).(map[string]interface{})))
+			continue
 		}
+		projected, err := projection.Apply(utils.Document(doc), filter)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, Document(projected))
 	}
 	return results, nil
 }
 
-func (m *MockDocDB) DeleteDocument(collection string, filter interface{}) error {
+// matchSorted returns the positions of the documents of collection matching
+// filter, ordered by sortSpec when it is set and by collection order
+// otherwise. Callers must hold m.lock.
+func (m *MockDocDB) matchSorted(collection string, filter utils.Document, sortSpec interface{}) ([]int, error) {
+	var keys []utils.SortKey
+	if sortSpec != nil {
+		var err error
+		if keys, err = utils.ParseSortSpec(sortSpec); err != nil {
+			return nil, err
+		}
+	}
+	positions, _, err := m.matchDocuments(collection, filter)
+	if err != nil || len(keys) == 0 {
+		return positions, err
+	}
+	documents := m.documents[collection]
+	sort.SliceStable(positions, func(i, j int) bool {
+		return utils.CompareBySortKeys(documents[positions[i]], documents[positions[j]], keys) < 0
+	})
+	return positions, nil
+}
+
+// Explain runs filter against collection like FindDocument and describes how
+// it was answered, in the shape of DocumentDB's explain("executionStats")
+// output: queryPlanner.winningPlan.stage is IXSCAN, with the indexName, when
+// an index narrowed down the documents and COLLSCAN otherwise, and
+// executionStats reports totalKeysExamined and totalDocsExamined.
+func (m *MockDocDB) Explain(collection string, filter interface{}) (Document, error) {
+	if m.mockConfig.ErrorMode {
+		return nil, errors.New("simulated error")
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	_, plan, err := m.matchDocuments(collection, filterMap)
+	if err != nil {
+		return nil, err
+	}
+	return plan.explain(collection, time.Since(start)), nil
+}
+
+// DeleteDocument removes the first document matching filter. Like the
+// driver's DeleteOne it is not an error when nothing matches; the result's
+// DeletedCount is 0 instead.
+func (m *MockDocDB) DeleteDocument(collection string, filter interface{}) (*mongo.DeleteResult, error) {
 	if m.mockConfig.ErrorMode {
-		return errors.New("simulated error")
+		return nil, errors.New("simulated error")
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
-	if documents, ok := m.documents[collection]; ok {
-		for i, doc := range documents {
-			match := true
-			if filterMap, ok := filter.(map[string]interface{}); ok {
-				for key, value := range filterMap {
-					if doc[key] != value {
-						match = false
-						break
-					}
-				}
-				if match {
-					fmt.Printf("Deleting document: %+v\n", doc)
-					// Delete the document by removing it from the slice
-					m.documents[collection] = append(documents[:i], documents[i+1:]...)
-					return nil
-				}
-			}
-		}
-		fmt.Println("No matching document found for deletion.")
-		return errors.New("no matching document found")
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	positions, _, err := m.matchDocuments(collection, filterMap)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("Collection not found.")
-	return errors.New("collection not found")
+	if len(positions) == 0 {
+		return &mongo.DeleteResult{}, nil
+	}
+	logger.Get().Info("Deleting document", zap.Any("document", m.documents[collection][positions[0]]))
+	m.removeDocuments(collection, map[int]bool{positions[0]: true})
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
 }
 
-func (m *MockDocDB) DeleteMany(collection string, filter Document) (int, error) {
+// DeleteMany removes every document matching filter.
+func (m *MockDocDB) DeleteMany(collection string, filter Document) (*mongo.DeleteResult, error) {
 	if m.mockConfig.ErrorMode {
 		logger.Get().Error("Simulated error in DeleteMany", zap.String("collection", collection))
-		return 0, errors.New("simulated error")
+		return nil, errors.New("simulated error")
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -178,25 +407,24 @@ func (m *MockDocDB) DeleteMany(collection string, filter Document) (int, error)
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
-	documents, ok := m.documents[collection]
-	if !ok {
-		return 0, errors.New("collection not found")
+	positions, _, err := m.matchDocuments(collection, utils.Document(filter))
+	if err != nil {
+		return nil, err
 	}
-	var newDocuments []Document
-	deletedCount := 0
-	for _, doc := range documents {
-		if utils.MatchesFilter(utils.Document(doc), utils.Document(filter)) {
-			deletedCount++
-			logger.Get().Info("Deleting document", zap.Any("document", doc))
-		} else {
-			newDocuments = append(newDocuments, doc)
-		}
+	removed := make(map[int]bool, len(positions))
+	for _, pos := range positions {
+		removed[pos] = true
+		logger.Get().Info("Deleting document", zap.Any("document", m.documents[collection][pos]))
+	}
+	if len(removed) > 0 {
+		m.removeDocuments(collection, removed)
 	}
-	m.documents[collection] = newDocuments
-	return deletedCount, nil
+	return &mongo.DeleteResult{DeletedCount: int64(len(positions))}, nil
 }
 
-func (m *MockDocDB) CountDocuments(collection string, filter interface{}) (int, error) {
+// CountDocuments returns the number of documents matching filter. The skip
+// and limit options apply to the matching documents as they do in a find.
+func (m *MockDocDB) CountDocuments(collection string, filter interface{}, opts ...*options.CountOptions) (int, error) {
 	if m.mockConfig.ErrorMode {
 		return 0, errors.New("simulated error")
 	}
@@ -205,20 +433,115 @@ func (m *MockDocDB) CountDocuments(collection string, filter interface{}) (int,
 	if m.mockConfig.SimulateLatency {
 		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
 	}
+	skip, limit := mergeCountOptions(opts)
+	if skip < 0 {
+		return 0, errors.New("skip value must be non-negative")
+	}
 	if documents, ok := m.documents[collection]; ok {
-		if filter == nil {
-			return len(documents), nil
-		}
-		if filterMap, ok := filter.(map[string]interface{}); ok {
-			count := 0
-			for _, doc := range documents {
-				if utils.MatchesFilter(utils.Document(doc), utils.Document(filterMap)) {
-					count++
-				}
+		count := len(documents)
+		if filter != nil {
+			filterMap, ok := utils.AsDocument(filter)
+			if !ok {
+				return 0, errors.New("invalid filter format")
 			}
-			return count, nil
+			positions, _, err := m.matchDocuments(collection, utils.Document(filterMap))
+			if err != nil {
+				return 0, err
+			}
+			count = len(positions)
+		}
+		count -= int(skip)
+		if count < 0 {
+			count = 0
 		}
-		return 0, errors.New("invalid filter format")
+		if limit > 0 && int64(count) > limit {
+			count = int(limit)
+		}
+		return count, nil
 	}
 	return 0, errors.New("collection not found")
 }
+
+// EstimatedDocumentCount returns the number of documents in collection from
+// its metadata, without looking at the documents. A missing collection has
+// none.
+func (m *MockDocDB) EstimatedDocumentCount(collection string) (int64, error) {
+	if m.mockConfig.ErrorMode {
+		return 0, errors.New("simulated error")
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	return int64(len(m.documents[collection])), nil
+}
+
+// Distinct returns the distinct values of fieldName, which may be a dotted
+// path, among the documents matching filter, in the order they are first
+// met. The elements of array values are counted individually, and values
+// that compare equal are returned once, so the integer 1 and the double 1.0
+// are the same value.
+func (m *MockDocDB) Distinct(collection string, fieldName string, filter interface{}) ([]interface{}, error) {
+	if m.mockConfig.ErrorMode {
+		return nil, errors.New("simulated error")
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	positions, _, err := m.matchDocuments(collection, filterMap)
+	if err != nil {
+		return nil, err
+	}
+	documents := m.documents[collection]
+	seen := make(map[string]bool)
+	values := []interface{}{}
+	add := func(value interface{}) {
+		if key := utils.KeyString(value); !seen[key] {
+			seen[key] = true
+			values = append(values, utils.CopyValue(value))
+		}
+	}
+	for _, pos := range positions {
+		for _, value := range utils.ResolvePath(documents[pos], fieldName) {
+			if elements, ok := utils.AsArray(value); ok {
+				for _, elem := range elements {
+					add(elem)
+				}
+				continue
+			}
+			add(value)
+		}
+	}
+	return values, nil
+}
+
+// storedDocument returns the copy of document that an insert stores, so
+// later changes to the caller's map don't leak into the collection. A new
+// ObjectID is generated when there is no _id.
+func storedDocument(document map[string]interface{}) Document {
+	stored := Document(utils.CopyValue(document).(map[string]interface{}))
+	if _, ok := stored["_id"]; !ok {
+		stored["_id"] = primitive.NewObjectID()
+	}
+	return stored
+}
+
+// filterDocument converts a caller-supplied filter into a utils.Document. A nil
+// filter matches every document.
+func filterDocument(filter interface{}) (utils.Document, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	filterMap, ok := utils.AsDocument(filter)
+	if !ok {
+		return nil, errors.New("invalid filter format")
+	}
+	return filterMap, nil
+}
@@ -0,0 +1,152 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// defaultFirstBatchSize is the number of documents a server returns in the
+// first batch of a query when no batch size is set.
+const defaultFirstBatchSize = 101
+
+// ErrCursorClosed is returned when a closed cursor is used.
+var ErrCursorClosed = errors.New("cursor is closed")
+
+// Cursor iterates over the results of a query like the driver's
+// *mongo.Cursor. The results are fetched in batches of the requested batch
+// size: the context passed to Next, TryNext or All is checked whenever a new
+// batch is needed, as the driver does when it sends a getMore.
+type Cursor struct {
+	// Current is the document the cursor is positioned on.
+	Current bson.Raw
+
+	pending   []bson.Raw
+	batch     []bson.Raw
+	batchSize int
+	err       error
+	closed    bool
+}
+
+// newCursor returns a cursor over docs, which are encoded straight away so
+// later writes to the collection don't change the results.
+func newCursor(docs []Document, batchSize int32) (*Cursor, error) {
+	pending := make([]bson.Raw, 0, len(docs))
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, raw)
+	}
+	c := &Cursor{pending: pending, batchSize: int(batchSize)}
+	first := c.batchSize
+	if first <= 0 {
+		first = defaultFirstBatchSize
+	}
+	c.fetch(first)
+	return c, nil
+}
+
+// fetch moves up to n pending documents into the current batch; n <= 0
+// fetches all of them.
+func (c *Cursor) fetch(n int) {
+	if n <= 0 || n > len(c.pending) {
+		n = len(c.pending)
+	}
+	c.batch, c.pending = c.pending[:n], c.pending[n:]
+}
+
+// Next moves the cursor to the next document, fetching the next batch when
+// the current one is used up. It returns false when the results are
+// exhausted or an error occurred, which Err reports.
+func (c *Cursor) Next(ctx context.Context) bool {
+	return c.next(ctx)
+}
+
+// TryNext is Next for cursors that are not tailable, which never wait for
+// new documents: it returns false once the results are exhausted.
+func (c *Cursor) TryNext(ctx context.Context) bool {
+	return c.next(ctx)
+}
+
+func (c *Cursor) next(ctx context.Context) bool {
+	if c.closed || c.err != nil {
+		return false
+	}
+	if len(c.batch) == 0 {
+		if len(c.pending) == 0 {
+			return false
+		}
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if err := ctx.Err(); err != nil {
+			c.err = err
+			return false
+		}
+		c.fetch(c.batchSize)
+	}
+	c.Current, c.batch = c.batch[0], c.batch[1:]
+	return true
+}
+
+// Decode unmarshals the current document into val.
+func (c *Cursor) Decode(val interface{}) error {
+	if c.Current == nil {
+		return errors.New("cursor is not positioned on a document")
+	}
+	return bson.Unmarshal(c.Current, val)
+}
+
+// All decodes every remaining document into results, which must be a
+// pointer to a slice, and closes the cursor.
+func (c *Cursor) All(ctx context.Context, results interface{}) error {
+	sliceVal := reflect.ValueOf(results)
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
+		return errors.New("results argument must be a pointer to a slice")
+	}
+	if c.closed {
+		return ErrCursorClosed
+	}
+	defer c.Close(ctx)
+	slice := sliceVal.Elem()
+	slice.SetLen(0)
+	elemType := slice.Type().Elem()
+	for c.Next(ctx) {
+		elem := reflect.New(elemType)
+		if err := bson.Unmarshal(c.Current, elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return c.err
+}
+
+// RemainingBatchLength returns the number of documents left in the current
+// batch, which Next returns without fetching another.
+func (c *Cursor) RemainingBatchLength() int {
+	return len(c.batch)
+}
+
+// ID returns the cursor id, which is 0 once every batch has been fetched.
+func (c *Cursor) ID() int64 {
+	if c.closed || len(c.pending) == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Err returns the error that ended the iteration, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the cursor. Closing a closed cursor is not an error.
+func (c *Cursor) Close(ctx context.Context) error {
+	c.closed = true
+	c.batch, c.pending, c.Current = nil, nil, nil
+	return nil
+}
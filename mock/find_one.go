@@ -0,0 +1,161 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kylejryan/mocument/internal/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindOne returns the first document matching filter, in the order of the
+// sort option when it is set. The result's error is mongo.ErrNoDocuments
+// when nothing matches.
+func (m *MockDocDB) FindOne(ctx context.Context, collection string, filter interface{}, opts ...*options.FindOneOptions) *SingleResult {
+	if m.mockConfig.ErrorMode {
+		return newSingleResult(nil, errors.New("simulated error"))
+	}
+	if err := ctx.Err(); err != nil {
+		return newSingleResult(nil, err)
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return newSingleResult(nil, err)
+	}
+	results, err := m.find(collection, filterMap, mergeFindOneOptions(opts))
+	if err != nil {
+		return newSingleResult(nil, err)
+	}
+	if len(results) == 0 {
+		return newSingleResult(nil, mongo.ErrNoDocuments)
+	}
+	return newSingleResult(results[0], nil)
+}
+
+// FindOneAndUpdate applies update to the first document matching filter, in
+// the order of the sort option when it is set, and returns the document as
+// it was before the update, or as it is after it when ReturnDocument is
+// options.After. With upsert set a document is inserted when nothing
+// matches; it is only returned with options.After.
+func (m *MockDocDB) FindOneAndUpdate(ctx context.Context, collection string, filter, update interface{}, opts ...*options.FindOneAndUpdateOptions) *SingleResult {
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return newSingleResult(nil, err)
+	}
+	updateMap, ok := utils.AsDocument(update)
+	if !ok {
+		return newSingleResult(nil, errors.New("invalid update format"))
+	}
+	settings := mergeFindOneAndUpdateOptions(opts)
+	updateCtx := &utils.UpdateContext{Now: m.now(), Filter: filterMap, ArrayFilters: settings.arrayFilters}
+	change := func(doc utils.Document) (utils.Document, bool, error) {
+		return utils.ApplyUpdate(doc, updateMap, updateCtx)
+	}
+	insert := func() (utils.Document, error) {
+		updateCtx.Inserting = true
+		return utils.UpsertDocument(filterMap, updateMap, updateCtx)
+	}
+	return m.findAndModify(ctx, collection, filterMap, settings, change, insert)
+}
+
+// FindOneAndReplace replaces the first document matching filter, in the
+// order of the sort option when it is set, with replacement, keeping its
+// _id. It returns the document as FindOneAndUpdate does.
+func (m *MockDocDB) FindOneAndReplace(ctx context.Context, collection string, filter, replacement interface{}, opts ...*options.FindOneAndReplaceOptions) *SingleResult {
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return newSingleResult(nil, err)
+	}
+	replacementMap, ok := utils.AsDocument(replacement)
+	if !ok {
+		return newSingleResult(nil, errors.New("invalid replacement format"))
+	}
+	if err := utils.ValidateReplacement(replacementMap); err != nil {
+		return newSingleResult(nil, err)
+	}
+	change := func(doc utils.Document) (utils.Document, bool, error) {
+		return utils.ReplaceDocument(doc, replacementMap)
+	}
+	insert := func() (utils.Document, error) {
+		return utils.UpsertReplacement(filterMap, replacementMap)
+	}
+	return m.findAndModify(ctx, collection, filterMap, mergeFindOneAndReplaceOptions(opts), change, insert)
+}
+
+// FindOneAndDelete removes the first document matching filter, in the order
+// of the sort option when it is set, and returns it.
+func (m *MockDocDB) FindOneAndDelete(ctx context.Context, collection string, filter interface{}, opts ...*options.FindOneAndDeleteOptions) *SingleResult {
+	filterMap, err := filterDocument(filter)
+	if err != nil {
+		return newSingleResult(nil, err)
+	}
+	return m.findAndModify(ctx, collection, filterMap, mergeFindOneAndDeleteOptions(opts), nil, nil)
+}
+
+// findAndModify changes the first document matching filter with change, or
+// removes it when change is nil, and returns it as it was before or, when
+// settings.returnAfter is set, as it is after. insert builds the document
+// an upsert inserts.
+func (m *MockDocDB) findAndModify(ctx context.Context, collection string, filter utils.Document, settings findAndModifySettings, change func(utils.Document) (utils.Document, bool, error), insert func() (utils.Document, error)) *SingleResult {
+	if m.mockConfig.ErrorMode {
+		return newSingleResult(nil, errors.New("simulated error"))
+	}
+	if err := ctx.Err(); err != nil {
+		return newSingleResult(nil, err)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	var projection *utils.Projection
+	if settings.projection != nil {
+		var err error
+		if projection, err = utils.ParseProjection(settings.projection); err != nil {
+			return newSingleResult(nil, err)
+		}
+	}
+	positions, err := m.matchSorted(collection, filter, settings.sort)
+	if err != nil {
+		return newSingleResult(nil, err)
+	}
+	var before, after Document
+	if len(positions) > 0 {
+		positions = positions[:1]
+		before = m.documents[collection][positions[0]]
+	}
+	if change == nil {
+		if before != nil {
+			m.removeDocuments(collection, map[int]bool{positions[0]: true})
+		}
+	} else {
+		if !settings.upsert {
+			insert = nil
+		}
+		if _, after, err = m.changeDocuments(collection, positions, change, insert); err != nil {
+			return newSingleResult(nil, err)
+		}
+	}
+	doc := before
+	if settings.returnAfter {
+		doc = after
+	}
+	if doc == nil {
+		return newSingleResult(nil, mongo.ErrNoDocuments)
+	}
+	if projection != nil {
+		projected, err := projection.Apply(utils.Document(doc), filter)
+		if err != nil {
+			return newSingleResult(nil, err)
+		}
+		doc = Document(projected)
+	}
+	return newSingleResult(doc, nil)
+}
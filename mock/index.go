@@ -0,0 +1,669 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kylejryan/mocument/internal/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// duplicateKeyCode is the server error code for a unique index violation,
+// which mongo.IsDuplicateKeyError looks for.
+const duplicateKeyCode = 11000
+
+// index is one index of a collection. Every collection has the unique _id_
+// index; others are added with CreateIndex.
+type index struct {
+	name   string
+	keys   []utils.SortKey
+	unique bool
+	// sparse indexes skip documents that have none of the indexed fields.
+	sparse bool
+	// partialFilter, when set, limits the index to the documents matching it.
+	partialFilter utils.Document
+	// expireAfterSeconds, when set, makes this a TTL index: documents expire
+	// that long after the date in the indexed field.
+	expireAfterSeconds *int32
+	// data is guarded by MockDocDB.indexLock.
+	data *indexData
+}
+
+func idIndex() *index {
+	return &index{name: "_id_", keys: []utils.SortKey{{Path: "_id"}}, unique: true}
+}
+
+// indexesFor returns the indexes of collection, starting with _id_. Callers
+// must hold m.indexLock, or m.lock for writing.
+func (m *MockDocDB) indexesFor(collection string) []*index {
+	indexes, ok := m.indexes[collection]
+	if !ok {
+		indexes = []*index{idIndex()}
+		m.indexes[collection] = indexes
+	}
+	return indexes
+}
+
+// CreateIndex adds the index described by model to collection and returns
+// its name. The keys must be a bson.D unless there is only one, and the
+// unique, sparse, partialFilterExpression, expireAfterSeconds and name
+// options are honored.
+// Creating an index that already exists with the same options is a no-op,
+// and a unique index cannot be created over documents that already share a
+// key.
+func (m *MockDocDB) CreateIndex(collection string, model mongo.IndexModel) (string, error) {
+	if m.mockConfig.ErrorMode {
+		return "", errors.New("simulated error")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	ix, err := newIndex(model)
+	if err != nil {
+		return "", err
+	}
+	indexes := m.indexesFor(collection)
+	for _, existing := range indexes {
+		if existing.name == ix.name || sameKeys(existing.keys, ix.keys) {
+			if existing.name == ix.name && existing.equal(ix) {
+				return ix.name, nil
+			}
+			return "", fmt.Errorf("an index named %s with key %s already exists with different options", existing.name, existing.keySpec())
+		}
+	}
+	documents := m.documents[collection]
+	data, writeErr := buildIndexData(collection, ix, documents, m.rows[collection])
+	if writeErr != nil {
+		return "", mongo.WriteException{WriteErrors: mongo.WriteErrors{*writeErr}}
+	}
+	ix.data = data
+	m.indexes[collection] = append(indexes, ix)
+	if documents == nil {
+		m.documents[collection] = []Document{}
+	}
+	return ix.name, nil
+}
+
+// DropIndex removes the index called name from collection. The _id_ index
+// cannot be dropped, and "*" drops every other index.
+func (m *MockDocDB) DropIndex(collection string, name string) error {
+	if m.mockConfig.ErrorMode {
+		return errors.New("simulated error")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	if name == "_id_" {
+		return errors.New("cannot drop _id index")
+	}
+	indexes := m.indexesFor(collection)
+	if name == "*" {
+		m.indexes[collection] = indexes[:1]
+		return nil
+	}
+	for i, ix := range indexes {
+		if ix.name == name {
+			m.indexes[collection] = append(indexes[:i:i], indexes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+// ListIndexes describes the indexes of collection in the form the server
+// returns them, e.g. {"v": 2, "key": bson.D{{"email", 1}}, "name": "email_1",
+// "unique": true}.
+func (m *MockDocDB) ListIndexes(collection string) ([]Document, error) {
+	if m.mockConfig.ErrorMode {
+		return nil, errors.New("simulated error")
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.mockConfig.SimulateLatency {
+		time.Sleep(time.Duration(m.mockConfig.LatencyMs) * time.Millisecond)
+	}
+	if _, ok := m.documents[collection]; !ok {
+		return nil, errors.New("collection not found")
+	}
+	var specs []Document
+	for _, ix := range m.indexesFor(collection) {
+		spec := Document{"v": int32(2), "key": ix.keySpec(), "name": ix.name}
+		if ix.unique && ix.name != "_id_" {
+			spec["unique"] = true
+		}
+		if ix.sparse {
+			spec["sparse"] = true
+		}
+		if ix.expireAfterSeconds != nil {
+			spec["expireAfterSeconds"] = *ix.expireAfterSeconds
+		}
+		if ix.partialFilter != nil {
+			spec["partialFilterExpression"] = Document(utils.CopyValue(map[string]interface{}(ix.partialFilter)).(map[string]interface{}))
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// newIndex validates model and converts it into an index.
+func newIndex(model mongo.IndexModel) (*index, error) {
+	if d, ok := utils.AsDocument(model.Keys); ok && len(d) > 1 {
+		if _, ordered := model.Keys.(primitive.D); !ordered {
+			return nil, errors.New("index keys must be an ordered document such as bson.D")
+		}
+	}
+	keys, err := utils.ParseSortSpec(model.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index key pattern: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("index keys cannot be empty")
+	}
+	ix := &index{keys: keys}
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s_%d", key.Path, direction(key))
+	}
+	ix.name = strings.Join(parts, "_")
+	if opts := model.Options; opts != nil {
+		if opts.Name != nil {
+			ix.name = *opts.Name
+		}
+		ix.unique = opts.Unique != nil && *opts.Unique
+		ix.sparse = opts.Sparse != nil && *opts.Sparse
+		if opts.PartialFilterExpression != nil {
+			filter, ok := utils.AsDocument(opts.PartialFilterExpression)
+			if !ok {
+				return nil, errors.New("partialFilterExpression must be a document")
+			}
+			if _, err := utils.MatchesFilter(utils.Document{}, filter); err != nil {
+				return nil, fmt.Errorf("invalid partialFilterExpression: %w", err)
+			}
+			ix.partialFilter = utils.Document(utils.CopyValue(filter).(map[string]interface{}))
+		}
+		if opts.ExpireAfterSeconds != nil {
+			if *opts.ExpireAfterSeconds < 0 {
+				return nil, errors.New("expireAfterSeconds must be a non-negative number")
+			}
+			if len(keys) > 1 {
+				return nil, errors.New("TTL indexes are single-field indexes, compound indexes do not support TTL")
+			}
+			if keys[0].Path == "_id" {
+				return nil, errors.New("the field '_id' does not support TTL indexes")
+			}
+			seconds := *opts.ExpireAfterSeconds
+			ix.expireAfterSeconds = &seconds
+		}
+	}
+	if ix.name == "" {
+		return nil, errors.New("index name cannot be empty")
+	}
+	return ix, nil
+}
+
+func direction(key utils.SortKey) int32 {
+	if key.Descending {
+		return -1
+	}
+	return 1
+}
+
+// keySpec returns the key pattern of the index, e.g. bson.D{{"email", 1}}.
+func (ix *index) keySpec() bson.D {
+	spec := make(bson.D, len(ix.keys))
+	for i, key := range ix.keys {
+		spec[i] = bson.E{Key: key.Path, Value: direction(key)}
+	}
+	return spec
+}
+
+func sameKeys(a, b []utils.SortKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equal reports whether two indexes have the same keys and options.
+func (ix *index) equal(other *index) bool {
+	return ix.name == other.name && sameKeys(ix.keys, other.keys) && ix.unique == other.unique &&
+		ix.sparse == other.sparse && utils.KeyString(ix.partialFilter) == utils.KeyString(other.partialFilter) &&
+		(ix.expireAfterSeconds == nil) == (other.expireAfterSeconds == nil) &&
+		(ix.expireAfterSeconds == nil || *ix.expireAfterSeconds == *other.expireAfterSeconds)
+}
+
+// covers reports whether doc belongs in the index, which leaves out documents
+// without any indexed field when sparse and those not matching the partial
+// filter.
+func (ix *index) covers(doc Document) bool {
+	if ix.sparse {
+		found := false
+		for _, key := range ix.keys {
+			found = found || len(utils.ResolvePath(utils.Document(doc), key.Path)) > 0
+		}
+		if !found {
+			return false
+		}
+	}
+	if ix.partialFilter != nil {
+		matched, err := utils.MatchesFilter(utils.Document(doc), ix.partialFilter)
+		return err == nil && matched
+	}
+	return true
+}
+
+// indexEntry is one key a document has in an index.
+type indexEntry struct {
+	key    string
+	values []interface{}
+	// row is the row id of the document, which never changes while the
+	// document is stored.
+	row uint64
+}
+
+// entries returns the keys doc has in the index and whether any of them
+// came from an array. A missing field indexes as null, and a field holding
+// an array is indexed by each of its elements.
+func (ix *index) entries(doc Document) ([]indexEntry, bool) {
+	if !ix.covers(doc) {
+		return nil, false
+	}
+	combinations := [][]interface{}{nil}
+	multikey := false
+	for _, key := range ix.keys {
+		values, fromArray := indexValues(doc, key.Path)
+		multikey = multikey || fromArray
+		next := make([][]interface{}, 0, len(combinations)*len(values))
+		for _, combination := range combinations {
+			for _, value := range values {
+				next = append(next, append(append([]interface{}{}, combination...), value))
+			}
+		}
+		combinations = next
+	}
+	seen := make(map[string]bool, len(combinations))
+	entries := make([]indexEntry, 0, len(combinations))
+	for _, values := range combinations {
+		key := utils.KeyString(values)
+		if !seen[key] {
+			seen[key] = true
+			entries = append(entries, indexEntry{key: key, values: values})
+		}
+	}
+	return entries, multikey
+}
+
+// indexValues returns the values doc has at path and whether they came
+// from an array, either at the end of the path or along the way, as with
+// "a.b" over a: [{b: 1}, {b: 2}]. Such an index is multikey.
+func indexValues(doc Document, path string) ([]interface{}, bool) {
+	var values []interface{}
+	resolved := utils.ResolvePath(utils.Document(doc), path)
+	fromArray := len(resolved) > 1 || crossesArray(doc, path)
+	for _, value := range resolved {
+		if elements, ok := utils.AsArray(value); ok {
+			fromArray = true
+			if len(elements) == 0 {
+				values = append(values, nil)
+			}
+			values = append(values, elements...)
+		} else {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return []interface{}{nil}, fromArray
+	}
+	return values, fromArray
+}
+
+// crossesArray reports whether any field on the way to the end of path,
+// such as a in "a.b", holds an array.
+func crossesArray(doc Document, path string) bool {
+	segments := strings.Split(path, ".")
+	for i := 1; i < len(segments); i++ {
+		for _, value := range utils.ResolvePath(utils.Document(doc), strings.Join(segments[:i], ".")) {
+			if _, ok := utils.AsArray(value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexData is the content of an index: its entries in key order and, for a
+// unique index, the row of the document holding each key. It is built the
+// first time it is needed and kept up to date by writes after that. Entries
+// refer to documents by row id rather than position, so deleting a document
+// leaves the entries of the others alone. Writes collect the entries they
+// add in pending and the ones they remove in dead, and those are merged
+// into entries in one pass once there are enough of them.
+type indexData struct {
+	entries []indexEntry
+	// pending holds the entries added since the last merge, unsorted.
+	pending []indexEntry
+	// dead holds the entries removed since the last merge, which are still
+	// in entries or pending.
+	dead     map[entryRef]indexEntry
+	keys     map[string]uint64
+	multikey bool
+}
+
+// entryRef identifies an index entry.
+type entryRef struct {
+	key string
+	row uint64
+}
+
+// maxUnmerged is the number of pending and dead entries an index keeps
+// before merging them. Queries check every pending entry, while a merge
+// moves every entry, so this balances the two.
+const maxUnmerged = 256
+
+// buildIndexData indexes docs, whose row ids are rows. For a unique index
+// the first duplicate key is returned as an error.
+func buildIndexData(collection string, ix *index, docs []Document, rows []uint64) (*indexData, *mongo.WriteError) {
+	data := &indexData{dead: make(map[entryRef]indexEntry)}
+	if ix.unique {
+		data.keys = make(map[string]uint64, len(docs))
+	}
+	for pos, doc := range docs {
+		entries, multikey := ix.entries(doc)
+		if entry := data.duplicate(entries, nil); entry != nil {
+			return nil, &mongo.WriteError{Code: duplicateKeyCode, Message: duplicateKeyMessage(collection, ix, *entry)}
+		}
+		for _, entry := range entries {
+			entry.row = rows[pos]
+			data.entries = append(data.entries, entry)
+			if data.keys != nil {
+				data.keys[entry.key] = entry.row
+			}
+		}
+		data.multikey = data.multikey || multikey
+	}
+	sort.Slice(data.entries, func(i, j int) bool { return compareEntries(data.entries[i], data.entries[j]) < 0 })
+	return data, nil
+}
+
+// duplicate returns the first of entries whose key is already used in a
+// unique index by a document other than those in released.
+func (d *indexData) duplicate(entries []indexEntry, released map[uint64]bool) *indexEntry {
+	if d.keys == nil {
+		return nil
+	}
+	for i := range entries {
+		if row, ok := d.keys[entries[i].key]; ok && !released[row] {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// add indexes the document at row by entries. An entry that was dropped
+// since the last merge, as when an update leaves an indexed field as it
+// was, is revived rather than added again.
+func (d *indexData) add(entries []indexEntry, multikey bool, row uint64) {
+	for _, entry := range entries {
+		entry.row = row
+		if d.keys != nil {
+			d.keys[entry.key] = row
+		}
+		if ref := (entryRef{entry.key, row}); d.isDead(ref) {
+			delete(d.dead, ref)
+			continue
+		}
+		d.pending = append(d.pending, entry)
+	}
+	d.multikey = d.multikey || multikey
+	d.mergeIfFull()
+}
+
+// drop removes the entries of the document at row, which is being updated
+// or deleted.
+func (d *indexData) drop(entries []indexEntry, row uint64) {
+	for _, entry := range entries {
+		entry.row = row
+		if d.keys != nil && d.keys[entry.key] == row {
+			delete(d.keys, entry.key)
+		}
+		d.dead[entryRef{entry.key, row}] = entry
+	}
+	d.mergeIfFull()
+}
+
+func (d *indexData) isDead(ref entryRef) bool {
+	if len(d.dead) == 0 {
+		return false
+	}
+	_, ok := d.dead[ref]
+	return ok
+}
+
+func (d *indexData) mergeIfFull() {
+	if len(d.pending)+len(d.dead) > maxUnmerged {
+		d.merge()
+	}
+}
+
+// merge sorts the pending entries into the others and takes out the dead
+// ones. Both are few, so each is placed by binary search and the entries
+// between them are copied over in runs.
+func (d *indexData) merge() {
+	type change struct {
+		entry  indexEntry
+		insert bool
+	}
+	changes := make([]change, 0, len(d.pending)+len(d.dead))
+	for _, entry := range d.pending {
+		if ref := (entryRef{entry.key, entry.row}); d.isDead(ref) {
+			// Added and removed again since the last merge.
+			delete(d.dead, ref)
+			continue
+		}
+		changes = append(changes, change{entry: entry, insert: true})
+	}
+	for _, entry := range d.dead {
+		changes = append(changes, change{entry: entry})
+	}
+	sort.Slice(changes, func(i, j int) bool { return compareEntries(changes[i].entry, changes[j].entry) < 0 })
+	merged := make([]indexEntry, 0, len(d.entries)+len(changes))
+	next := 0
+	for _, c := range changes {
+		rest := d.entries[next:]
+		i := sort.Search(len(rest), func(i int) bool { return compareEntries(rest[i], c.entry) >= 0 })
+		merged = append(merged, rest[:i]...)
+		next += i
+		if c.insert {
+			merged = append(merged, c.entry)
+		} else if next < len(d.entries) && d.entries[next].row == c.entry.row && d.entries[next].key == c.entry.key {
+			next++
+		}
+	}
+	d.entries = append(merged, d.entries[next:]...)
+	d.pending = nil
+	d.dead = make(map[entryRef]indexEntry)
+}
+
+// compareEntries orders entries by their values, then by row, which is the
+// order of the documents in their collection.
+func compareEntries(a, b indexEntry) int {
+	for i := range a.values {
+		if c := utils.CompareValues(a.values[i], b.values[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a.row < b.row:
+		return -1
+	case a.row > b.row:
+		return 1
+	}
+	return 0
+}
+
+// loadIndex returns the data of ix, building it from the documents of
+// collection when needed. Callers must hold m.lock and m.indexLock.
+func (m *MockDocDB) loadIndex(collection string, ix *index) *indexData {
+	if ix.data == nil {
+		// Stored documents never violate a unique index, so building
+		// cannot fail here.
+		ix.data, _ = buildIndexData(collection, ix, m.documents[collection], m.rows[collection])
+	}
+	return ix.data
+}
+
+// positionsOf returns the positions in collection of the documents with the
+// given row ids, in collection order. Rows are numbered in insertion order
+// and documents never move past each other, so the row ids of a collection
+// are sorted and a row is found by binary search. Callers must hold m.lock.
+func (m *MockDocDB) positionsOf(collection string, rows []uint64) []int {
+	sort.Slice(rows, func(i, j int) bool { return rows[i] < rows[j] })
+	all := m.rows[collection]
+	positions := make([]int, len(rows))
+	for i, row := range rows {
+		positions[i] = sort.Search(len(all), func(j int) bool { return all[j] >= row })
+	}
+	return positions
+}
+
+// appendDocument stores doc at the end of collection, unless it would
+// duplicate a unique index key. Callers must hold m.lock for writing.
+func (m *MockDocDB) appendDocument(collection string, doc Document) *mongo.WriteError {
+	return m.writeDocuments(collection, []int{len(m.documents[collection])}, []Document{doc})
+}
+
+// writeDocuments stores docs[i] at position changed[i] of collection,
+// replacing the document there, or appending it when the position is just
+// past the end. The other documents stay unchanged and where they were. A
+// change that would duplicate a unique index key is returned as an error
+// and leaves the collection as it was. Callers must hold m.lock for writing.
+func (m *MockDocDB) writeDocuments(collection string, changed []int, docs []Document) *mongo.WriteError {
+	m.indexLock.Lock()
+	defer m.indexLock.Unlock()
+	indexes := m.indexesFor(collection)
+	// The keys of the documents being replaced are free for the new ones.
+	rows := m.rows[collection]
+	released := make(map[uint64]bool, len(changed))
+	for _, pos := range changed {
+		if pos < len(rows) {
+			released[rows[pos]] = true
+		}
+	}
+	entries := make([][][]indexEntry, len(indexes))
+	multikey := make([][]bool, len(indexes))
+	for i, ix := range indexes {
+		entries[i] = make([][]indexEntry, len(changed))
+		multikey[i] = make([]bool, len(changed))
+		var data *indexData
+		taken := make(map[string]bool)
+		if ix.unique {
+			data = m.loadIndex(collection, ix)
+		}
+		for j := range changed {
+			entries[i][j], multikey[i][j] = ix.entries(docs[j])
+			if data == nil {
+				continue
+			}
+			entry := data.duplicate(entries[i][j], released)
+			for k := range entries[i][j] {
+				if entry == nil && taken[entries[i][j][k].key] {
+					entry = &entries[i][j][k]
+				}
+				taken[entries[i][j][k].key] = true
+			}
+			if entry != nil {
+				return &mongo.WriteError{Code: duplicateKeyCode, Message: duplicateKeyMessage(collection, ix, *entry)}
+			}
+		}
+	}
+	documents := m.documents[collection]
+	for _, pos := range changed {
+		if pos == len(rows) {
+			m.nextRow++
+			rows = append(rows, m.nextRow)
+		}
+	}
+	for i, ix := range indexes {
+		if ix.data == nil {
+			continue
+		}
+		for _, pos := range changed {
+			if released[rows[pos]] {
+				old, _ := ix.entries(documents[pos])
+				ix.data.drop(old, rows[pos])
+			}
+		}
+		for j, pos := range changed {
+			ix.data.add(entries[i][j], multikey[i][j], rows[pos])
+		}
+	}
+	for j, pos := range changed {
+		if pos == len(documents) {
+			documents = append(documents, docs[j])
+		} else {
+			documents[pos] = docs[j]
+		}
+	}
+	m.documents[collection] = documents
+	m.rows[collection] = rows
+	return nil
+}
+
+// removeDocuments deletes the documents at the given positions from
+// collection. Callers must hold m.lock for writing.
+func (m *MockDocDB) removeDocuments(collection string, positions map[int]bool) {
+	m.indexLock.Lock()
+	defer m.indexLock.Unlock()
+	documents, rows := m.documents[collection], m.rows[collection]
+	for _, ix := range m.indexesFor(collection) {
+		if ix.data == nil {
+			continue
+		}
+		for pos := range positions {
+			old, _ := ix.entries(documents[pos])
+			ix.data.drop(old, rows[pos])
+		}
+	}
+	kept := make([]Document, 0, len(documents))
+	keptRows := make([]uint64, 0, len(rows))
+	for pos, doc := range documents {
+		if !positions[pos] {
+			kept = append(kept, doc)
+			keptRows = append(keptRows, rows[pos])
+		}
+	}
+	m.documents[collection] = kept
+	m.rows[collection] = keptRows
+}
+
+// duplicateKeyMessage formats a duplicate key error the way the server does,
+// e.g. E11000 duplicate key error collection: users index: _id_ dup key: { _id: 1 }.
+func duplicateKeyMessage(collection string, ix *index, entry indexEntry) string {
+	fields := make([]string, len(ix.keys))
+	for i, key := range ix.keys {
+		value := entry.values[i]
+		if s, ok := value.(string); ok {
+			fields[i] = fmt.Sprintf("%s: %q", key.Path, s)
+		} else if value == nil {
+			fields[i] = key.Path + ": null"
+		} else {
+			fields[i] = fmt.Sprintf("%s: %v", key.Path, value)
+		}
+	}
+	return fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: { %s }",
+		collection, ix.name, strings.Join(fields, ", "))
+}
@@ -0,0 +1,222 @@
+package mock
+
+import (
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// updateSettings is the combined form of the driver's UpdateOptions that the
+// mock honors.
+type updateSettings struct {
+	arrayFilters []interface{}
+	upsert       bool
+}
+
+// mergeUpdateOptions combines opts with the last value set for an option
+// winning, as the driver does.
+func mergeUpdateOptions(opts []*options.UpdateOptions) updateSettings {
+	var settings updateSettings
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.ArrayFilters != nil {
+			settings.arrayFilters = opt.ArrayFilters.Filters
+		}
+		if opt.Upsert != nil {
+			settings.upsert = *opt.Upsert
+		}
+	}
+	return settings
+}
+
+// mergeInsertManyOptions reports whether an InsertMany is ordered, which is
+// the default: an ordered insert stops at the first failing document.
+func mergeInsertManyOptions(opts []*options.InsertManyOptions) bool {
+	ordered := true
+	for _, opt := range opts {
+		if opt != nil && opt.Ordered != nil {
+			ordered = *opt.Ordered
+		}
+	}
+	return ordered
+}
+
+// findSettings is the combined form of the driver's FindOptions that the mock
+// honors.
+type findSettings struct {
+	sort       interface{}
+	projection interface{}
+	skip       int64
+	limit      int64
+	batchSize  int32
+}
+
+// mergeFindOptions combines opts with the last value set for an option
+// winning. A negative limit is treated as its absolute value, as the driver
+// does for a single batch.
+func mergeFindOptions(opts []*options.FindOptions) findSettings {
+	var settings findSettings
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			settings.sort = opt.Sort
+		}
+		if opt.Projection != nil {
+			settings.projection = opt.Projection
+		}
+		if opt.Skip != nil {
+			settings.skip = *opt.Skip
+		}
+		if opt.Limit != nil {
+			settings.limit = *opt.Limit
+		}
+		if opt.BatchSize != nil {
+			settings.batchSize = *opt.BatchSize
+		}
+	}
+	if settings.limit < 0 {
+		settings.limit = -settings.limit
+	}
+	return settings
+}
+
+// mergeFindOneOptions converts FindOneOptions into the settings of a find
+// limited to one document.
+func mergeFindOneOptions(opts []*options.FindOneOptions) findSettings {
+	settings := findSettings{limit: 1}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			settings.sort = opt.Sort
+		}
+		if opt.Projection != nil {
+			settings.projection = opt.Projection
+		}
+		if opt.Skip != nil {
+			settings.skip = *opt.Skip
+		}
+	}
+	return settings
+}
+
+// findAndModifySettings is the combined form of the options of the
+// FindOneAnd* methods that the mock honors.
+type findAndModifySettings struct {
+	sort         interface{}
+	projection   interface{}
+	arrayFilters []interface{}
+	upsert       bool
+	// returnAfter is set when the document is returned as it is after the
+	// change rather than before it.
+	returnAfter bool
+}
+
+func mergeFindOneAndUpdateOptions(opts []*options.FindOneAndUpdateOptions) findAndModifySettings {
+	var settings findAndModifySettings
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			settings.sort = opt.Sort
+		}
+		if opt.Projection != nil {
+			settings.projection = opt.Projection
+		}
+		if opt.ArrayFilters != nil {
+			settings.arrayFilters = opt.ArrayFilters.Filters
+		}
+		if opt.Upsert != nil {
+			settings.upsert = *opt.Upsert
+		}
+		if opt.ReturnDocument != nil {
+			settings.returnAfter = *opt.ReturnDocument == options.After
+		}
+	}
+	return settings
+}
+
+func mergeFindOneAndReplaceOptions(opts []*options.FindOneAndReplaceOptions) findAndModifySettings {
+	var settings findAndModifySettings
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			settings.sort = opt.Sort
+		}
+		if opt.Projection != nil {
+			settings.projection = opt.Projection
+		}
+		if opt.Upsert != nil {
+			settings.upsert = *opt.Upsert
+		}
+		if opt.ReturnDocument != nil {
+			settings.returnAfter = *opt.ReturnDocument == options.After
+		}
+	}
+	return settings
+}
+
+func mergeFindOneAndDeleteOptions(opts []*options.FindOneAndDeleteOptions) findAndModifySettings {
+	var settings findAndModifySettings
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			settings.sort = opt.Sort
+		}
+		if opt.Projection != nil {
+			settings.projection = opt.Projection
+		}
+	}
+	return settings
+}
+
+// mergeReplaceOptions reports whether a ReplaceOne upserts.
+func mergeReplaceOptions(opts []*options.ReplaceOptions) bool {
+	upsert := false
+	for _, opt := range opts {
+		if opt != nil && opt.Upsert != nil {
+			upsert = *opt.Upsert
+		}
+	}
+	return upsert
+}
+
+// mergeCountOptions returns the skip and limit of a CountDocuments. A
+// negative limit is treated as its absolute value.
+func mergeCountOptions(opts []*options.CountOptions) (int64, int64) {
+	var skip, limit int64
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Skip != nil {
+			skip = *opt.Skip
+		}
+		if opt.Limit != nil {
+			limit = *opt.Limit
+		}
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	return skip, limit
+}
+
+// mergeAggregateOptions returns the batch size of an Aggregate.
+func mergeAggregateOptions(opts []*options.AggregateOptions) int32 {
+	var batchSize int32
+	for _, opt := range opts {
+		if opt != nil && opt.BatchSize != nil {
+			batchSize = *opt.BatchSize
+		}
+	}
+	return batchSize
+}
@@ -0,0 +1,328 @@
+package mock
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kylejryan/mocument/internal/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// queryPlan records how a query was answered: by scanning one index for the
+// candidate documents (IXSCAN) or by scanning the whole collection
+// (COLLSCAN), and how much work that took.
+type queryPlan struct {
+	index        *index
+	keysExamined int
+	docsExamined int
+	returned     int
+}
+
+func (p *queryPlan) stage() string {
+	if p.index == nil {
+		return "COLLSCAN"
+	}
+	return "IXSCAN"
+}
+
+// interval is a range of index values of one BSON type, such as the numbers
+// greater than 5. Values of other types are never inside it.
+type interval struct {
+	rank                        int
+	low, high                   interface{}
+	hasLow, hasHigh             bool
+	lowInclusive, highInclusive bool
+}
+
+func pointInterval(v interface{}) interval {
+	return interval{rank: utils.TypeRank(v), low: v, high: v, hasLow: true, hasHigh: true, lowInclusive: true, highInclusive: true}
+}
+
+// below reports whether v sorts before every value in the interval.
+func (iv interval) below(v interface{}) bool {
+	if rank := utils.TypeRank(v); rank != iv.rank {
+		return rank < iv.rank
+	}
+	if !iv.hasLow {
+		return false
+	}
+	c := utils.CompareValues(v, iv.low)
+	return c < 0 || (c == 0 && !iv.lowInclusive)
+}
+
+// above reports whether v sorts after every value in the interval.
+func (iv interval) above(v interface{}) bool {
+	if rank := utils.TypeRank(v); rank != iv.rank {
+		return rank > iv.rank
+	}
+	if !iv.hasHigh {
+		return false
+	}
+	c := utils.CompareValues(v, iv.high)
+	return c > 0 || (c == 0 && !iv.highInclusive)
+}
+
+func (iv interval) contains(v interface{}) bool {
+	return !iv.below(v) && !iv.above(v)
+}
+
+// fieldBounds returns the intervals an index value must fall in for a
+// document to match condition on that field, or false when the condition
+// cannot be answered from an index, as with $ne, $regex or array equality.
+// On a multikey index each operator may be satisfied by a different array
+// element, so range operators are not combined there.
+func fieldBounds(condition interface{}, multikey bool) ([]interval, bool) {
+	if !indexable(condition) {
+		return nil, false
+	}
+	operators, ok := utils.AsDocument(condition)
+	if !ok || !isOperatorDocument(operators) {
+		return []interval{pointInterval(condition)}, true
+	}
+	if eq, ok := operators["$eq"]; ok && indexable(eq) {
+		return []interval{pointInterval(eq)}, true
+	}
+	if in, ok := operators["$in"]; ok {
+		if values, ok := utils.AsArray(in); ok {
+			intervals := make([]interval, 0, len(values))
+			seen := make(map[string]bool, len(values))
+			usable := true
+			for _, value := range values {
+				usable = usable && indexable(value)
+				if key := utils.KeyString(value); !seen[key] {
+					seen[key] = true
+					intervals = append(intervals, pointInterval(value))
+				}
+			}
+			if usable {
+				sort.Slice(intervals, func(i, j int) bool {
+					return utils.CompareValues(intervals[i].low, intervals[j].low) < 0
+				})
+				return intervals, true
+			}
+		}
+	}
+	var bound *interval
+	for _, operator := range []string{"$gt", "$gte", "$lt", "$lte"} {
+		operand, ok := operators[operator]
+		if !ok || !rangeOperand(operand) {
+			continue
+		}
+		rank := utils.TypeRank(operand)
+		if bound == nil {
+			bound = &interval{rank: rank}
+		} else if bound.rank != rank || multikey {
+			continue
+		}
+		switch operator {
+		case "$gt", "$gte":
+			if !bound.hasLow || utils.CompareValues(operand, bound.low) > 0 {
+				bound.low, bound.hasLow, bound.lowInclusive = operand, true, operator == "$gte"
+			}
+		default:
+			if !bound.hasHigh || utils.CompareValues(operand, bound.high) < 0 {
+				bound.high, bound.hasHigh, bound.highInclusive = operand, true, operator == "$lte"
+			}
+		}
+	}
+	if bound == nil {
+		return nil, false
+	}
+	return []interval{*bound}, true
+}
+
+func isOperatorDocument(d map[string]interface{}) bool {
+	for key := range d {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// indexable reports whether equality with v can be looked up in an index.
+// Arrays match as whole values and regular expressions match by pattern, so
+// neither can.
+func indexable(v interface{}) bool {
+	switch v.(type) {
+	case primitive.Regex, *regexp.Regexp:
+		return false
+	}
+	_, isArray := utils.AsArray(v)
+	return !isArray
+}
+
+// rangeOperand reports whether a range operator on v selects a contiguous
+// range of one type. Ranges on null, MinKey and MaxKey span types.
+func rangeOperand(v interface{}) bool {
+	switch utils.BSONType(v) {
+	case "null", "undefined", "minKey", "maxKey", "array":
+		return false
+	}
+	return indexable(v)
+}
+
+// matchDocuments returns the positions, in collection order, of the
+// documents of collection matching filter, using the index that narrows the
+// search down the most. Only the top-level conditions of the filter are
+// used to pick an index; every candidate is still checked against the whole
+// filter. Callers must hold m.lock.
+func (m *MockDocDB) matchDocuments(collection string, filter utils.Document) ([]int, *queryPlan, error) {
+	documents := m.documents[collection]
+	plan := &queryPlan{}
+	var candidates []int
+	if len(filter) > 0 {
+		m.indexLock.Lock()
+		candidates = m.planIndexScan(collection, filter, plan)
+		m.indexLock.Unlock()
+	}
+	if plan.index == nil {
+		candidates = make([]int, len(documents))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+	var positions []int
+	for _, pos := range candidates {
+		plan.docsExamined++
+		matched, err := utils.MatchesFilter(utils.Document(documents[pos]), filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		if matched {
+			positions = append(positions, pos)
+		}
+	}
+	plan.returned = len(positions)
+	return positions, plan, nil
+}
+
+// planIndexScan scans every index that the filter's conditions on its
+// leading field apply to and keeps the one leaving the fewest documents to
+// fetch, breaking ties by the number of keys examined. An index entry is
+// fetched when its values are within the bounds of every indexed field the
+// filter constrains. Sparse and partial indexes leave documents out, so they
+// are not used. plan.index stays nil when no index applies. Callers must
+// hold m.lock and m.indexLock.
+func (m *MockDocDB) planIndexScan(collection string, filter utils.Document, plan *queryPlan) []int {
+	var best []int
+	for _, ix := range m.indexesFor(collection) {
+		if ix.sparse || ix.partialFilter != nil {
+			continue
+		}
+		condition, ok := filter[ix.keys[0].Path]
+		if !ok {
+			continue
+		}
+		data := m.loadIndex(collection, ix)
+		leading, ok := fieldBounds(condition, data.multikey)
+		if !ok {
+			continue
+		}
+		bounds := [][]interval{leading}
+		for _, key := range ix.keys[1:] {
+			var intervals []interval
+			if condition, ok := filter[key.Path]; ok {
+				intervals, _ = fieldBounds(condition, data.multikey)
+			}
+			bounds = append(bounds, intervals)
+		}
+		rows, keysExamined := data.scan(bounds)
+		positions := m.positionsOf(collection, rows)
+		if plan.index == nil || len(positions) < len(best) ||
+			(len(positions) == len(best) && keysExamined < plan.keysExamined) {
+			plan.index, plan.keysExamined, best = ix, keysExamined, positions
+		}
+	}
+	return best
+}
+
+// scan returns the row ids of the documents with an entry within bounds,
+// which hold the intervals for each indexed field, and the number of keys
+// examined on the way. Pending entries are not sorted yet, so each one is
+// checked against the leading intervals.
+func (d *indexData) scan(bounds [][]interval) ([]uint64, int) {
+	seen := make(map[uint64]bool)
+	var rows []uint64
+	keysExamined := 0
+	visit := func(entry indexEntry) {
+		if d.isDead(entryRef{entry.key, entry.row}) {
+			return
+		}
+		keysExamined++
+		if !entryWithin(entry, bounds) || seen[entry.row] {
+			return
+		}
+		seen[entry.row] = true
+		rows = append(rows, entry.row)
+	}
+	for _, iv := range bounds[0] {
+		start, end := d.span(iv)
+		for _, entry := range d.entries[start:end] {
+			visit(entry)
+		}
+		for _, entry := range d.pending {
+			if iv.contains(entry.values[0]) {
+				visit(entry)
+			}
+		}
+	}
+	return rows, keysExamined
+}
+
+// span returns the range of entries whose leading value is in iv.
+func (d *indexData) span(iv interval) (int, int) {
+	start := sort.Search(len(d.entries), func(i int) bool { return !iv.below(d.entries[i].values[0]) })
+	end := start + sort.Search(len(d.entries)-start, func(i int) bool { return iv.above(d.entries[start+i].values[0]) })
+	return start, end
+}
+
+// entryWithin reports whether every value of entry is in one of the
+// intervals for its field. A field without intervals is unconstrained.
+func entryWithin(entry indexEntry, bounds [][]interval) bool {
+	for i, intervals := range bounds {
+		if len(intervals) == 0 {
+			continue
+		}
+		within := false
+		for _, iv := range intervals {
+			within = within || iv.contains(entry.values[i])
+		}
+		if !within {
+			return false
+		}
+	}
+	return true
+}
+
+// explain describes plan in the shape of a DocumentDB explain() result.
+func (p *queryPlan) explain(collection string, elapsed time.Duration) Document {
+	winningPlan := Document{"stage": p.stage()}
+	if p.index != nil {
+		winningPlan["indexName"] = p.index.name
+		winningPlan["keyPattern"] = p.index.keySpec()
+		winningPlan["direction"] = "forward"
+	}
+	return Document{
+		"queryPlanner": Document{
+			"plannerVersion": 1,
+			"namespace":      collection,
+			"winningPlan":    winningPlan,
+		},
+		"executionStats": Document{
+			"executionSuccess":    true,
+			"nReturned":           p.returned,
+			"executionTimeMillis": elapsed.Milliseconds(),
+			"totalKeysExamined":   p.keysExamined,
+			"totalDocsExamined":   p.docsExamined,
+			"executionStages": Document{
+				"stage":        p.stage(),
+				"nReturned":    p.returned,
+				"keysExamined": p.keysExamined,
+				"docsExamined": p.docsExamined,
+			},
+		},
+	}
+}
@@ -0,0 +1,45 @@
+package mock
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SingleResult holds the document returned by FindOne and the FindOneAnd*
+// methods, like the driver's *mongo.SingleResult. When nothing matched, its
+// error is mongo.ErrNoDocuments.
+type SingleResult struct {
+	raw bson.Raw
+	err error
+}
+
+// newSingleResult encodes doc straight away so later writes to the
+// collection don't change the result.
+func newSingleResult(doc Document, err error) *SingleResult {
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	return &SingleResult{raw: raw}
+}
+
+// Decode unmarshals the document into v, or returns the result's error.
+func (r *SingleResult) Decode(v interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return bson.Unmarshal(r.raw, v)
+}
+
+// Raw returns the document as BSON along with the result's error.
+func (r *SingleResult) Raw() (bson.Raw, error) {
+	return r.raw, r.err
+}
+
+// Err returns the error of the operation, which is mongo.ErrNoDocuments
+// when no document matched.
+func (r *SingleResult) Err() error {
+	return r.err
+}
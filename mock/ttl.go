@@ -0,0 +1,146 @@
+package mock
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kylejryan/mocument/internal/utils"
+	"github.com/kylejryan/mocument/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// Clock tells MockDocDB what time it is.
+type Clock interface {
+	Now() time.Time
+}
+
+// MockClock is a Clock that only moves when told to, so tests can expire
+// documents deterministically.
+type MockClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewMockClock returns a MockClock set to start.
+func NewMockClock(start time.Time) *MockClock {
+	return &MockClock{now: start}
+}
+
+// Now returns the time the clock is set to.
+func (c *MockClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *MockClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *MockClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = t
+}
+
+func (m *MockDocDB) now() time.Time {
+	if m.mockConfig.Clock != nil {
+		return m.mockConfig.Clock.Now()
+	}
+	return time.Now()
+}
+
+// ReapExpired deletes the documents that have expired under the TTL indexes
+// of every collection and returns how many were removed. A document expires
+// expireAfterSeconds after the date in the indexed field, or after the
+// earliest date when the field is an array; documents where the field holds
+// no date never expire. Like the server's TTL monitor, it must be run for
+// documents to go away: call it after advancing a MockClock, or use
+// StartTTLMonitor.
+func (m *MockDocDB) ReapExpired() (int, error) {
+	if m.mockConfig.ErrorMode {
+		return 0, errors.New("simulated error")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.now()
+	reaped := 0
+	for collection, documents := range m.documents {
+		expired := make(map[int]bool)
+		for _, ix := range m.indexes[collection] {
+			if ix.expireAfterSeconds == nil {
+				continue
+			}
+			ttl := time.Duration(*ix.expireAfterSeconds) * time.Second
+			for pos, doc := range documents {
+				if expiry, ok := earliestDate(doc, ix.keys[0].Path); ok && !expiry.Add(ttl).After(now) && ix.covers(doc) {
+					expired[pos] = true
+				}
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		for pos := range expired {
+			logger.Get().Info("Expiring document", zap.String("collection", collection), zap.Any("document", documents[pos]))
+		}
+		m.removeDocuments(collection, expired)
+		reaped += len(expired)
+	}
+	return reaped, nil
+}
+
+// earliestDate returns the earliest date stored at path in doc.
+func earliestDate(doc Document, path string) (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for _, value := range utils.ResolvePath(utils.Document(doc), path) {
+		values := []interface{}{value}
+		if elements, ok := utils.AsArray(value); ok {
+			values = elements
+		}
+		for _, v := range values {
+			var t time.Time
+			switch date := v.(type) {
+			case time.Time:
+				t = date
+			case primitive.DateTime:
+				t = date.Time()
+			default:
+				continue
+			}
+			if !found || t.Before(earliest) {
+				earliest, found = t, true
+			}
+		}
+	}
+	return earliest, found
+}
+
+// StartTTLMonitor runs ReapExpired every interval in the background, as the
+// server does every 60 seconds, until the returned stop function is called.
+func (m *MockDocDB) StartTTLMonitor(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.ReapExpired(); err != nil {
+					logger.Get().Error("TTL monitor failed", zap.Error(err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -2,11 +2,15 @@ package mock
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	. "github.com/kylejryan/mocument/mock"
 )
@@ -17,7 +21,7 @@ func TestInsertAndFindDocument(t *testing.T) {
 
 	// Insert a document
 	doc := Document{"name": "test"}
-	err := mockDocDB.InsertDocument("collection", doc)
+	_, err := mockDocDB.InsertDocument("collection", doc)
 	assert.NoError(t, err)
 
 	// Find the document
@@ -35,9 +39,9 @@ func TestInsertAndFindMultipleDocuments(t *testing.T) {
 	// Insert multiple documents
 	doc1 := Document{"name": "test1"}
 	doc2 := Document{"name": "test2"}
-	err := mockDocDB.InsertDocument("collection", doc1)
+	_, err := mockDocDB.InsertDocument("collection", doc1)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc2)
+	_, err = mockDocDB.InsertDocument("collection", doc2)
 	assert.NoError(t, err)
 
 	// Find all documents
@@ -52,13 +56,13 @@ func TestUpdateDocument(t *testing.T) {
 
 	// Insert a document
 	doc := Document{"name": "test", "value": 1}
-	err := mockDocDB.InsertDocument("collection", doc)
+	_, err := mockDocDB.InsertDocument("collection", doc)
 	assert.NoError(t, err)
 
 	// Update the document using $set operator
 	filter := Document{"name": "test"}
 	update := Document{"$set": Document{"value": 2}}
-	err = mockDocDB.UpdateMany("collection", filter, update)
+	_, err = mockDocDB.UpdateMany("collection", filter, update)
 	assert.NoError(t, err)
 
 	// Verify the update
@@ -74,7 +78,7 @@ func TestDeleteDocument(t *testing.T) {
 
 	// Insert a document and capture the inserted document with _id
 	doc := Document{"name": "test"}
-	err := mockDocDB.InsertDocument("collection", doc)
+	_, err := mockDocDB.InsertDocument("collection", doc)
 	assert.NoError(t, err)
 
 	// Find the inserted document to get its _id
@@ -85,7 +89,7 @@ func TestDeleteDocument(t *testing.T) {
 	insertedDoc := results[0]
 
 	// Delete the document using its _id
-	err = mockDocDB.DeleteDocument("collection", Document{"_id": insertedDoc["_id"]})
+	_, err = mockDocDB.DeleteDocument("collection", Document{"_id": insertedDoc["_id"]})
 	assert.NoError(t, err)
 
 	// Verify the document is deleted
@@ -113,7 +117,7 @@ func TestInsertAndFindTransaction(t *testing.T) {
 	doc := loadJSONFixture("testdata/sample_transaction.json", t)
 
 	// Insert the transaction document
-	err := mockDocDB.InsertDocument("transactions", doc)
+	_, err := mockDocDB.InsertDocument("transactions", doc)
 	assert.NoError(t, err)
 
 	// Find the transaction document
@@ -139,7 +143,7 @@ func TestInsertManyAndFindDocuments(t *testing.T) {
 	mockDocDB := NewMockDocDB(mockConfig)
 
 	// Insert multiple documents
-	err := mockDocDB.InsertMany("collection", []interface{}{
+	_, err := mockDocDB.InsertMany("collection", []interface{}{
 		Document{"name": "test1", "value": 1},
 		Document{"name": "test2", "value": 2},
 		Document{"name": "test3", "value": 3},
@@ -154,7 +158,7 @@ func TestInsertManyAndFindDocuments(t *testing.T) {
 	// Validate that all documents are correctly inserted
 	expectedValues := []int{1, 2, 3}
 	for i, result := range results {
-		assert.Equal(t, expectedValues[i], int(result["value"].(float64)))
+		assert.Equal(t, expectedValues[i], result["value"].(int))
 	}
 
 	// Filter and find a specific document
@@ -163,7 +167,7 @@ func TestInsertManyAndFindDocuments(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(specificResult))
 	assert.Equal(t, "test2", specificResult[0]["name"])
-	assert.Equal(t, 2, int(specificResult[0]["value"].(float64)))
+	assert.Equal(t, 2, specificResult[0]["value"].(int))
 }
 
 func TestCountDocuments(t *testing.T) {
@@ -174,11 +178,11 @@ func TestCountDocuments(t *testing.T) {
 	doc1 := Document{"name": "test1", "value": 1}
 	doc2 := Document{"name": "test2", "value": 2}
 	doc3 := Document{"name": "test3", "value": 3}
-	err := mockDocDB.InsertDocument("collection", doc1)
+	_, err := mockDocDB.InsertDocument("collection", doc1)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc2)
+	_, err = mockDocDB.InsertDocument("collection", doc2)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc3)
+	_, err = mockDocDB.InsertDocument("collection", doc3)
 	assert.NoError(t, err)
 
 	// Count all documents in the collection
@@ -207,31 +211,31 @@ func TestUpdateOne(t *testing.T) {
 	doc1 := Document{"name": "test1", "value": 1}
 	doc2 := Document{"name": "test2", "value": 2}
 	doc3 := Document{"name": "test3", "value": 3}
-	err := mockDocDB.InsertDocument("collection", doc1)
+	_, err := mockDocDB.InsertDocument("collection", doc1)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc2)
+	_, err = mockDocDB.InsertDocument("collection", doc2)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc3)
+	_, err = mockDocDB.InsertDocument("collection", doc3)
 	assert.NoError(t, err)
 
 	// Update one document
 	filter := Document{"name": "test2"}
 	update := Document{"value": 22}
-	err = mockDocDB.UpdateOne("collection", filter, update)
+	_, err = mockDocDB.UpdateOne("collection", filter, update)
 	assert.NoError(t, err)
 
 	// Verify the update
 	results, err := mockDocDB.FindDocument("collection", filter)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(results))
-	assert.Equal(t, 22, int(results[0]["value"].(float64)))
+	assert.Equal(t, 22, results[0]["value"].(int))
 
 	// Verify other documents are not updated
 	otherFilter := Document{"name": "test1"}
 	otherResults, err := mockDocDB.FindDocument("collection", otherFilter)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(otherResults))
-	assert.Equal(t, 1, int(otherResults[0]["value"].(float64)))
+	assert.Equal(t, 1, otherResults[0]["value"].(int))
 }
 
 func TestDeleteMany(t *testing.T) {
@@ -243,20 +247,20 @@ func TestDeleteMany(t *testing.T) {
 	doc2 := Document{"name": "test2", "value": 2}
 	doc3 := Document{"name": "test2", "value": 3}
 	doc4 := Document{"name": "test3", "value": 4}
-	err := mockDocDB.InsertDocument("collection", doc1)
+	_, err := mockDocDB.InsertDocument("collection", doc1)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc2)
+	_, err = mockDocDB.InsertDocument("collection", doc2)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc3)
+	_, err = mockDocDB.InsertDocument("collection", doc3)
 	assert.NoError(t, err)
-	err = mockDocDB.InsertDocument("collection", doc4)
+	_, err = mockDocDB.InsertDocument("collection", doc4)
 	assert.NoError(t, err)
 
 	// Delete documents with name "test2"
 	filter := Document{"name": "test2"}
-	deletedCount, err := mockDocDB.DeleteMany("collection", filter)
+	deleteResult, err := mockDocDB.DeleteMany("collection", filter)
 	assert.NoError(t, err)
-	assert.Equal(t, 2, deletedCount)
+	assert.Equal(t, int64(2), deleteResult.DeletedCount)
 
 	// Verify the remaining documents
 	results, err := mockDocDB.FindDocument("collection", nil)
@@ -281,7 +285,7 @@ func TestFindDocumentWithComplexFilter(t *testing.T) {
 		{"name": "Charlie", "age": 35, "city": "New York"},
 	}
 	for _, doc := range docs {
-		err := mockDocDB.InsertDocument("users", doc)
+		_, err := mockDocDB.InsertDocument("users", doc)
 		assert.NoError(t, err)
 	}
 
@@ -296,7 +300,7 @@ func TestFindDocumentWithComplexFilter(t *testing.T) {
 
 	// Verify results
 	for _, doc := range results {
-		age := doc["age"].(float64)
+		age := doc["age"].(int)
 		assert.True(t, age > 28)
 		assert.Equal(t, "New York", doc["city"])
 	}
@@ -313,7 +317,7 @@ func TestUpdateManyWithComplexUpdate(t *testing.T) {
 		{"name": "Product C", "price": 150, "stock": 0},
 	}
 	for _, doc := range docs {
-		err := mockDocDB.InsertDocument("products", doc)
+		_, err := mockDocDB.InsertDocument("products", doc)
 		assert.NoError(t, err)
 	}
 
@@ -323,17 +327,17 @@ func TestUpdateManyWithComplexUpdate(t *testing.T) {
 		"$inc": Document{"price": 10},
 		"$set": Document{"updated": true},
 	}
-	err := mockDocDB.UpdateMany("products", filter, update)
+	_, err := mockDocDB.UpdateMany("products", filter, update)
 	assert.NoError(t, err)
 
 	// Verify updates
 	results, err := mockDocDB.FindDocument("products", nil)
 	assert.NoError(t, err)
 	for _, doc := range results {
-		stock := int(doc["stock"].(float64))
+		stock := doc["stock"].(int)
 		if stock > 0 {
 			assert.Equal(t, true, doc["updated"])
-			expectedPrice := int(doc["price"].(float64))
+			expectedPrice := doc["price"].(int)
 			if doc["name"] == "Product A" {
 				assert.Equal(t, 110, expectedPrice)
 			} else if doc["name"] == "Product B" {
@@ -342,3 +346,137 @@ func TestUpdateManyWithComplexUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteResults(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	insertResult, err := mockDocDB.InsertDocument("collection", Document{"_id": "a", "name": "test", "value": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", insertResult.InsertedID)
+
+	manyResult, err := mockDocDB.InsertMany("collection", []interface{}{
+		Document{"_id": "b", "name": "test", "value": 2},
+		Document{"_id": "c", "name": "other", "value": 2},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"b", "c"}, manyResult.InsertedIDs)
+
+	// Setting a field to the value it already has matches without modifying
+	updateResult, err := mockDocDB.UpdateMany("collection", Document{"name": "test"}, Document{"$set": Document{"value": 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), updateResult.MatchedCount)
+	assert.Equal(t, int64(1), updateResult.ModifiedCount)
+	assert.Equal(t, int64(0), updateResult.UpsertedCount)
+
+	updateResult, err = mockDocDB.UpdateOne("collection", Document{"name": "missing"}, Document{"$set": Document{"value": 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), updateResult.MatchedCount)
+	assert.Equal(t, int64(0), updateResult.ModifiedCount)
+
+	deleteResult, err := mockDocDB.DeleteDocument("collection", Document{"name": "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), deleteResult.DeletedCount)
+	deleteResult, err = mockDocDB.DeleteDocument("collection", Document{"name": "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleteResult.DeletedCount)
+	deleteResult, err = mockDocDB.DeleteMany("collection", Document{"value": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleteResult.DeletedCount)
+	deleteResult, err = mockDocDB.DeleteMany("missing", Document{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), deleteResult.DeletedCount)
+}
+
+func TestDocumentIDs(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	// Missing ids are generated, caller-supplied ones are kept as given
+	insertResult, err := mockDocDB.InsertDocument("collection", Document{"name": "generated"})
+	assert.NoError(t, err)
+	generatedID, ok := insertResult.InsertedID.(primitive.ObjectID)
+	assert.True(t, ok)
+	assert.False(t, generatedID.IsZero())
+
+	manyResult, err := mockDocDB.InsertMany("collection", []interface{}{
+		Document{"_id": 7, "name": "int"},
+		Document{"name": "generated"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, manyResult.InsertedIDs[0])
+	assert.IsType(t, primitive.ObjectID{}, manyResult.InsertedIDs[1])
+	assert.NotEqual(t, generatedID, manyResult.InsertedIDs[1])
+
+	results, err := mockDocDB.FindDocument("collection", Document{"_id": generatedID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "generated", results[0]["name"])
+	results, err = mockDocDB.FindDocument("collection", Document{"_id": 7})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, 7, results[0]["_id"])
+
+	// _id is immutable, though setting it to its current value is allowed
+	_, err = mockDocDB.UpdateOne("collection", Document{"_id": 7}, Document{"$set": Document{"_id": 8}})
+	assert.Error(t, err)
+	_, err = mockDocDB.UpdateOne("collection", Document{"_id": 7}, Document{"$unset": Document{"_id": ""}})
+	assert.Error(t, err)
+	_, err = mockDocDB.UpdateOne("collection", Document{"_id": 7}, Document{"_id": "seven"})
+	assert.Error(t, err)
+	updateResult, err := mockDocDB.UpdateOne("collection", Document{"_id": 7}, Document{"$set": Document{"_id": 7, "name": "still int"}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), updateResult.ModifiedCount)
+	results, err = mockDocDB.FindDocument("collection", Document{"_id": 7})
+	assert.NoError(t, err)
+	assert.Equal(t, "still int", results[0]["name"])
+}
+
+func TestDuplicateKeyErrors(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertDocument("collection", Document{"_id": 1, "name": "first"})
+	assert.NoError(t, err)
+
+	// Ids are compared by value, so 1.0 collides with 1
+	_, err = mockDocDB.InsertDocument("collection", Document{"_id": 1.0, "name": "again"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	var writeException mongo.WriteException
+	assert.True(t, errors.As(err, &writeException))
+	assert.Equal(t, 11000, writeException.WriteErrors[0].Code)
+	assert.Contains(t, err.Error(), "E11000 duplicate key error collection: collection index: _id_ dup key: { _id: 1 }")
+
+	// An ordered InsertMany stops at the first duplicate
+	manyResult, err := mockDocDB.InsertMany("collection", []interface{}{
+		Document{"_id": 2}, Document{"_id": 1}, Document{"_id": 3},
+	})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.True(t, errors.As(err, &writeException))
+	assert.Equal(t, 1, len(writeException.WriteErrors))
+	assert.Equal(t, 1, writeException.WriteErrors[0].Index)
+	assert.Equal(t, []interface{}{2}, manyResult.InsertedIDs)
+
+	// An unordered one inserts the rest and reports every duplicate
+	manyResult, err = mockDocDB.InsertMany("collection", []interface{}{
+		Document{"_id": 3}, Document{"_id": 2}, Document{"_id": "a"}, Document{"_id": "a"},
+	}, options.InsertMany().SetOrdered(false))
+	assert.True(t, errors.As(err, &writeException))
+	assert.Equal(t, 2, len(writeException.WriteErrors))
+	assert.Equal(t, 1, writeException.WriteErrors[0].Index)
+	assert.Equal(t, 3, writeException.WriteErrors[1].Index)
+	assert.Contains(t, writeException.WriteErrors[1].Message, `dup key: { _id: "a" }`)
+	assert.Equal(t, []interface{}{3, "a"}, manyResult.InsertedIDs)
+
+	count, err := mockDocDB.CountDocuments("collection", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	// An upsert that would reuse an existing _id fails without inserting
+	_, err = mockDocDB.UpdateOne("collection", Document{"_id": 1, "name": "other"},
+		Document{"$set": Document{"seen": true}}, options.Update().SetUpsert(true))
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	count, err = mockDocDB.CountDocuments("collection", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
@@ -0,0 +1,528 @@
+package mock
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	. "github.com/kylejryan/mocument/mock"
+)
+
+func TestFindDocumentWithLogicalOperators(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	docs := []Document{
+		{"name": "Alice", "age": 30, "city": "New York"},
+		{"name": "Bob", "age": 25, "city": "Los Angeles"},
+		{"name": "Charlie", "age": 35, "city": "Chicago"},
+	}
+	for _, doc := range docs {
+		_, err := mockDocDB.InsertDocument("users", doc)
+		assert.NoError(t, err)
+	}
+
+	// $or across different fields
+	filter := Document{"$or": []interface{}{
+		Document{"city": "Los Angeles"},
+		Document{"name": "Charlie"},
+	}}
+	results, err := mockDocDB.FindDocument("users", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+
+	// $and nested inside $or
+	filter = Document{"$or": []Document{
+		{"$and": []Document{{"city": "New York"}, {"age": Document{"$gt": 28}}}},
+		{"name": "Bob"},
+	}}
+	count, err := mockDocDB.CountDocuments("users", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// $not wrapping a field-level operator
+	filter = Document{"age": Document{"$not": Document{"$gt": 28}}}
+	results, err = mockDocDB.FindDocument("users", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "Bob", results[0]["name"])
+
+	// $nor removes everything matched by any clause
+	filter = Document{"$nor": []Document{{"name": "Alice"}, {"name": "Bob"}}}
+	deleteResult, err := mockDocDB.DeleteMany("users", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleteResult.DeletedCount)
+
+	// Malformed logical operators are reported
+	_, err = mockDocDB.FindDocument("users", Document{"$or": []Document{}})
+	assert.Error(t, err)
+	_, err = mockDocDB.FindDocument("users", Document{"$where": "true"})
+	assert.Error(t, err)
+}
+
+func TestFindDocumentWithMembershipAndExistence(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	docs := []Document{
+		{"name": "Alice", "status": "active", "deletedAt": nil},
+		{"name": "Bob", "status": "archived", "nickname": "bobby"},
+		{"name": "Charlie", "status": "pending", "deletedAt": "2024-01-01"},
+		{"name": "Dana", "status": 3},
+	}
+	for _, doc := range docs {
+		_, err := mockDocDB.InsertDocument("users", doc)
+		assert.NoError(t, err)
+	}
+
+	// $in and $nin
+	count, err := mockDocDB.CountDocuments("users", Document{"status": Document{"$in": []string{"active", "pending"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"nickname": Document{"$nin": []interface{}{"bobby"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// Soft-deleted records: null or missing deletedAt means the record is live
+	count, err = mockDocDB.CountDocuments("users", Document{"deletedAt": nil})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"deletedAt": Document{"$ne": nil}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// $exists distinguishes explicit null from a missing field
+	count, err = mockDocDB.CountDocuments("users", Document{"deletedAt": Document{"$exists": true}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"nickname": Document{"$exists": false}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"nickname": Document{"$ne": "bobby"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// $type by alias, by numeric code and by array of types
+	count, err = mockDocDB.CountDocuments("users", Document{"deletedAt": Document{"$type": "null"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"status": Document{"$type": 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"status": Document{"$type": []interface{}{"number", "null"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = mockDocDB.CountDocuments("users", Document{"status": Document{"$type": "text"}})
+	assert.Error(t, err)
+}
+
+func TestFindDocumentWithDottedPaths(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	doc := loadJSONFixture("testdata/sample_transaction.json", t)
+	doc["Customer"] = map[string]interface{}{"Name": "Ada", "Address": map[string]interface{}{"City": "Boston"}}
+	_, err := mockDocDB.InsertDocument("transactions", doc)
+	assert.NoError(t, err)
+
+	// Implicit traversal of the Items array
+	results, err := mockDocDB.FindDocument("transactions", Document{"Items.ProductID": "prod001"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// Numeric index segments address a single element
+	count, err := mockDocDB.CountDocuments("transactions", Document{"Items.1.Quantity": Document{"$gte": 2.0}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Items.0.Quantity": Document{"$gte": 2.0}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// Nested documents, including absent paths
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Customer.Address.City": "Boston"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Customer.Address.Zip": Document{"$exists": false}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Updates resolve dotted paths as well
+	_, err = mockDocDB.UpdateOne("transactions", Document{"Items.ProductID": "prod002"}, Document{"Customer.Address.Zip": "02108"})
+	assert.NoError(t, err)
+	results, err = mockDocDB.FindDocument("transactions", Document{"Customer.Address.Zip": "02108"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "Boston", results[0]["Customer"].(map[string]interface{})["Address"].(map[string]interface{})["City"])
+}
+
+func TestFindDocumentWithArrayOperators(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	docs := []Document{
+		{"name": "shirt", "tags": []string{"red", "blue"}, "scores": []int{82, 95}},
+		{"name": "hat", "tags": []string{"red"}, "scores": []int{70, 90}},
+		{"name": "scarf", "tags": []string{"green", "blue", "wool"}, "scores": []int{60}},
+	}
+	for _, doc := range docs {
+		_, err := mockDocDB.InsertDocument("products", doc)
+		assert.NoError(t, err)
+	}
+	transaction := loadJSONFixture("testdata/sample_transaction.json", t)
+	_, err := mockDocDB.InsertDocument("transactions", transaction)
+	assert.NoError(t, err)
+
+	// A scalar filter matches any element of an array field
+	count, err := mockDocDB.CountDocuments("products", Document{"tags": "red"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// The whole array still matches exactly
+	count, err = mockDocDB.CountDocuments("products", Document{"tags": []string{"red"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// $all requires every listed tag
+	count, err = mockDocDB.CountDocuments("products", Document{"tags": Document{"$all": []string{"blue", "red"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// $size matches on array length
+	results, err := mockDocDB.FindDocument("products", Document{"tags": Document{"$size": 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "scarf", results[0]["name"])
+
+	// $elemMatch on scalar elements needs one element in range
+	count, err = mockDocDB.CountDocuments("products", Document{"scores": Document{"$elemMatch": Document{"$gte": 80, "$lt": 85}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// $elemMatch on line items requires both conditions on the same item
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Items": Document{"$elemMatch": Document{
+		"ProductID": "prod002",
+		"Quantity":  Document{"$gte": 2.0},
+	}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Items": Document{"$elemMatch": Document{
+		"ProductID": "prod001",
+		"Quantity":  Document{"$gte": 2.0},
+	}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// $all with $elemMatch items
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Items": Document{"$all": []interface{}{
+		Document{"$elemMatch": Document{"ProductID": "prod001"}},
+		Document{"$elemMatch": Document{"ProductID": "prod002"}},
+	}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestFindDocumentWithRangeOperators(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	for age := 15; age <= 40; age += 5 {
+		_, err := mockDocDB.InsertDocument("users", Document{"age": age})
+		assert.NoError(t, err)
+	}
+
+	// Both bounds apply, whatever order the map yields them in
+	for i := 0; i < 20; i++ {
+		count, err := mockDocDB.CountDocuments("users", Document{"age": Document{"$gt": 20, "$lt": 30}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	}
+
+	count, err := mockDocDB.CountDocuments("users", Document{"age": Document{"$gte": 20, "$lte": 30, "$ne": 25}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = mockDocDB.CountDocuments("users", Document{"age": Document{"$not": Document{"$gte": 20, "$lte": 30}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// Unknown operators are rejected rather than silently matching nothing
+	_, err = mockDocDB.FindDocument("users", Document{"age": Document{"$gt": 20, "$between": []int{20, 30}}})
+	assert.EqualError(t, err, "unknown operator: $between")
+	_, err = mockDocDB.FindDocument("users", Document{"missing": Document{"$near": 1}})
+	assert.Error(t, err)
+}
+
+func TestFindDocumentWithMixedNumericTypes(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	// Fixture numbers decode as float64
+	doc := loadJSONFixture("testdata/sample_transaction.json", t)
+	_, err := mockDocDB.InsertDocument("transactions", doc)
+	assert.NoError(t, err)
+
+	count, err := mockDocDB.CountDocuments("transactions", Document{"Items.Quantity": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Amount": Document{"$gt": 150}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Amount": Document{"$lte": int64(150)}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Amount": Document{"$gte": mustParseDecimal(t, "150.75")}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("transactions", Document{"Items.Quantity": Document{"$in": []int32{2}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestStoredNumbers(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	// Numbers are stored as given, so integers a float64 cannot hold exactly
+	// keep every digit
+	_, err := mockDocDB.InsertDocument("numbers", Document{"_id": "big", "n": int64(9007199254740993), "small": int32(42)})
+	assert.NoError(t, err)
+	docs, err := mockDocDB.FindDocument("numbers", Document{"_id": "big"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), docs[0]["n"])
+	assert.Equal(t, int32(42), docs[0]["small"])
+	count, err := mockDocDB.CountDocuments("numbers", Document{"n": int64(9007199254740993)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("numbers", Document{"n": int64(9007199254740992)})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = mockDocDB.CountDocuments("numbers", Document{"n": float64(9007199254740992)})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = mockDocDB.CountDocuments("numbers", Document{"small": 42.0})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Updates keep the types they were given too, so $type sees the same
+	// types whichever write stored a value
+	_, err = mockDocDB.InsertDocument("users", Document{"_id": 1, "age": 30, "scores": []interface{}{1, 2}})
+	assert.NoError(t, err)
+	_, err = mockDocDB.InsertDocument("users", Document{"_id": 2})
+	assert.NoError(t, err)
+	_, err = mockDocDB.UpdateOne("users", Document{"_id": 2}, Document{
+		"$set":  Document{"age": 25, "big": int64(-9007199254740993)},
+		"$inc":  Document{"logins": int32(1)},
+		"$push": Document{"scores": 3.5},
+	})
+	assert.NoError(t, err)
+	for _, query := range []struct {
+		filter Document
+		count  int
+	}{
+		{Document{"age": Document{"$type": "int"}}, 2},
+		{Document{"age": Document{"$type": "double"}}, 0},
+		{Document{"age": Document{"$type": "number"}}, 2},
+		{Document{"scores": Document{"$type": "int"}}, 1},
+		{Document{"scores": Document{"$type": "double"}}, 1},
+		{Document{"logins": Document{"$type": "int"}}, 1},
+		{Document{"big": Document{"$type": "long"}}, 1},
+	} {
+		count, err := mockDocDB.CountDocuments("users", query.filter)
+		assert.NoError(t, err)
+		assert.Equal(t, query.count, count, "%v", query.filter)
+	}
+	docs, err = mockDocDB.FindDocument("users", Document{"_id": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, Document{"_id": 2, "age": 25, "big": int64(-9007199254740993), "logins": int32(1), "scores": []interface{}{3.5}}, docs[0])
+}
+
+func TestFindDocumentWithMixedTypeField(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	docs := []Document{
+		{"name": "number", "value": 10},
+		{"name": "string", "value": "10"},
+		{"name": "null", "value": nil},
+		{"name": "bool", "value": true},
+		{"name": "date", "value": now},
+		{"name": "object", "value": map[string]interface{}{"a": 1}},
+	}
+	for _, doc := range docs {
+		_, err := mockDocDB.InsertDocument("values", doc)
+		assert.NoError(t, err)
+	}
+
+	// Range operators only match values of the operand's type
+	results, err := mockDocDB.FindDocument("values", Document{"value": Document{"$gt": 5}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "number", results[0]["name"])
+	results, err = mockDocDB.FindDocument("values", Document{"value": Document{"$gte": ""}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "string", results[0]["name"])
+
+	// Dates compare by instant
+	results, err = mockDocDB.FindDocument("values", Document{"value": Document{"$lt": now.Add(time.Hour), "$gt": now.Add(-time.Hour)}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "date", results[0]["name"])
+	count, err := mockDocDB.CountDocuments("values", Document{"value": primitive.NewDateTimeFromTime(now)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// MinKey and MaxKey bound every type in BSON order
+	count, err = mockDocDB.CountDocuments("values", Document{"value": Document{"$gt": primitive.MinKey{}, "$lt": primitive.MaxKey{}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, count)
+
+	// Embedded documents compare by content, not identity
+	count, err = mockDocDB.CountDocuments("values", Document{"value": Document{"a": 1.0}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func mustParseDecimal(t *testing.T, s string) primitive.Decimal128 {
+	d, err := primitive.ParseDecimal128(s)
+	assert.NoError(t, err)
+	return d
+}
+
+func TestFindDocumentWithRegex(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	docs := []Document{
+		{"email": "alice@example.com", "skus": []string{"AB-100", "CD-200"}},
+		{"email": "Bob@Example.com", "skus": []string{"ab-300"}},
+		{"email": "carol@test.org", "skus": []string{"EF-400"}},
+	}
+	for _, doc := range docs {
+		_, err := mockDocDB.InsertDocument("users", doc)
+		assert.NoError(t, err)
+	}
+
+	// $regex with and without $options
+	count, err := mockDocDB.CountDocuments("users", Document{"email": Document{"$regex": "@example\\.com$"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"email": Document{"$regex": "@example\\.com$", "$options": "i"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"email": Document{"$regex": "^ b o b  # the user name", "$options": "ix"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// primitive.Regex and *regexp.Regexp values as shorthand
+	count, err = mockDocDB.CountDocuments("users", Document{"email": primitive.Regex{Pattern: "^[ab]", Options: "i"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"email": regexp.MustCompile(`\.org$`)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// String elements inside arrays, $in with regexes and $not
+	count, err = mockDocDB.CountDocuments("users", Document{"skus": Document{"$regex": "^ab-", "$options": "i"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"skus": Document{"$in": []interface{}{regexp.MustCompile("^EF"), "CD-200"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = mockDocDB.CountDocuments("users", Document{"email": Document{"$not": primitive.Regex{Pattern: "example", Options: "i"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Invalid options and patterns are reported
+	_, err = mockDocDB.CountDocuments("users", Document{"email": Document{"$regex": "a", "$options": "q"}})
+	assert.Error(t, err)
+	_, err = mockDocDB.CountDocuments("users", Document{"email": Document{"$regex": "("}})
+	assert.Error(t, err)
+	_, err = mockDocDB.CountDocuments("users", Document{"email": Document{"$options": "i"}})
+	assert.Error(t, err)
+}
+
+func TestDistinct(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertMany("products", []interface{}{
+		Document{"category": "books", "rating": 1, "tags": []interface{}{"new", "sale"}, "meta": Document{"origin": "US"}},
+		Document{"category": "games", "rating": 1.0, "tags": []interface{}{"sale", []interface{}{"nested"}}, "meta": Document{"origin": "FR"}},
+		Document{"category": "books", "rating": int64(2), "tags": "sale", "variants": []interface{}{Document{"color": "red"}, Document{"color": "blue"}}},
+		Document{"category": "toys", "rating": nil, "variants": []interface{}{Document{"color": "red"}}},
+		Document{"category": "toys"},
+	})
+	assert.NoError(t, err)
+
+	values, err := mockDocDB.Distinct("products", "category", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"books", "games", "toys"}, values)
+
+	// Numbers of different types that compare equal are one value; null is a value
+	values, err = mockDocDB.Distinct("products", "rating", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{1, int64(2), nil}, values)
+
+	// Arrays are flattened one level
+	values, err = mockDocDB.Distinct("products", "tags", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"new", "sale", []interface{}{"nested"}}, values)
+
+	// Dotted paths reach into embedded documents and arrays of them
+	values, err = mockDocDB.Distinct("products", "variants.color", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"red", "blue"}, values)
+	values, err = mockDocDB.Distinct("products", "meta.origin", Document{"category": "books"})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"US"}, values)
+
+	values, err = mockDocDB.Distinct("products", "missing", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+	values, err = mockDocDB.Distinct("missing", "category", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+	_, err = mockDocDB.Distinct("products", "category", "books")
+	assert.Error(t, err)
+}
+
+func TestDocumentCounts(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	var docs []interface{}
+	for i := 0; i < 10; i++ {
+		docs = append(docs, Document{"n": i})
+	}
+	_, err := mockDocDB.InsertMany("items", docs)
+	assert.NoError(t, err)
+
+	estimate, err := mockDocDB.EstimatedDocumentCount("items")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), estimate)
+	estimate, err = mockDocDB.EstimatedDocumentCount("missing")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), estimate)
+
+	filter := Document{"n": Document{"$gte": 4}}
+	count, err := mockDocDB.CountDocuments("items", filter, options.Count().SetSkip(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	count, err = mockDocDB.CountDocuments("items", filter, options.Count().SetSkip(1).SetLimit(3))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = mockDocDB.CountDocuments("items", nil, options.Count().SetSkip(20))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = mockDocDB.CountDocuments("items", nil, options.Count().SetLimit(5))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	_, err = mockDocDB.CountDocuments("items", nil, options.Count().SetSkip(-1))
+	assert.Error(t, err)
+}
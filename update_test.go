@@ -0,0 +1,346 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	. "github.com/kylejryan/mocument/mock"
+)
+
+func TestUpdateOneWithFieldOperators(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	doc := Document{
+		"name":    "widget",
+		"price":   10,
+		"stock":   5,
+		"low":     3,
+		"high":    8,
+		"legacy":  "x",
+		"details": Document{"color": "red"},
+	}
+	_, err := mockDocDB.InsertDocument("products", doc)
+	assert.NoError(t, err)
+
+	update := Document{
+		"$set":         Document{"details.size": "L", "tags": []string{"new"}},
+		"$unset":       Document{"legacy": ""},
+		"$inc":         Document{"stock": -2, "views": 1},
+		"$mul":         Document{"price": 1.5, "discount": 2},
+		"$min":         Document{"low": 1},
+		"$max":         Document{"high": 4},
+		"$rename":      Document{"name": "title"},
+		"$currentDate": Document{"updatedAt": true, "stamp": Document{"$type": "timestamp"}},
+	}
+	_, err = mockDocDB.UpdateOne("products", Document{"name": "widget"}, update)
+	assert.NoError(t, err)
+
+	results, err := mockDocDB.FindDocument("products", Document{"title": "widget"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	updated := results[0]
+	assert.Equal(t, map[string]interface{}{"color": "red", "size": "L"}, updated["details"])
+	assert.Equal(t, []interface{}{"new"}, updated["tags"])
+	assert.NotContains(t, updated, "legacy")
+	assert.NotContains(t, updated, "name")
+	assert.Equal(t, 3, updated["stock"])
+	assert.Equal(t, 1, updated["views"])
+	assert.Equal(t, 15.0, updated["price"])
+	assert.Equal(t, 0, updated["discount"])
+	assert.Equal(t, 1, updated["low"])
+	assert.Equal(t, 8, updated["high"])
+	assert.WithinDuration(t, time.Now(), updated["updatedAt"].(time.Time), time.Minute)
+	assert.IsType(t, primitive.Timestamp{}, updated["stamp"])
+}
+
+func TestUpdateValidation(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	_, err := mockDocDB.InsertDocument("products", Document{"name": "widget", "stock": 5, "label": "a"})
+	assert.NoError(t, err)
+	filter := Document{"name": "widget"}
+
+	// Operators and plain fields cannot be mixed
+	_, err = mockDocDB.UpdateOne("products", filter, Document{"$set": Document{"stock": 1}, "label": "b"})
+	assert.Error(t, err)
+
+	// Unknown operators, conflicting paths and bad operands are rejected
+	_, err = mockDocDB.UpdateOne("products", filter, Document{"$increment": Document{"stock": 1}})
+	assert.Error(t, err)
+	_, err = mockDocDB.UpdateOne("products", filter, Document{"$set": Document{"details": 1}, "$unset": Document{"details.size": ""}})
+	assert.Error(t, err)
+	_, err = mockDocDB.UpdateOne("products", filter, Document{"$inc": Document{"stock": "1"}})
+	assert.Error(t, err)
+
+	// A failing update leaves the document untouched
+	_, err = mockDocDB.UpdateOne("products", filter, Document{"$set": Document{"stock": 1}, "$inc": Document{"label": 1}})
+	assert.Error(t, err)
+	results, err := mockDocDB.FindDocument("products", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, results[0]["stock"])
+	assert.Equal(t, "a", results[0]["label"])
+}
+
+func TestUpdateOneWithArrayOperators(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	doc := Document{
+		"cartID": "c1",
+		"items": []Document{
+			{"sku": "a", "qty": 1},
+			{"sku": "b", "qty": 5},
+		},
+		"tags":   []string{"new"},
+		"scores": []int{3, 7, 9, 2},
+		"audit":  []string{"created"},
+	}
+	_, err := mockDocDB.InsertDocument("carts", doc)
+	assert.NoError(t, err)
+	filter := Document{"cartID": "c1"}
+
+	// $push with $each, $sort and $slice keeps the three largest quantities
+	_, err = mockDocDB.UpdateOne("carts", filter, Document{"$push": Document{"items": Document{
+		"$each":  []Document{{"sku": "c", "qty": 3}, {"sku": "d", "qty": 0}},
+		"$sort":  Document{"qty": -1},
+		"$slice": 3,
+	}}})
+	assert.NoError(t, err)
+
+	// $push with $position prepends, $addToSet skips existing tags
+	_, err = mockDocDB.UpdateOne("carts", filter, Document{
+		"$push":     Document{"audit": Document{"$each": []string{"opened"}, "$position": 0}},
+		"$addToSet": Document{"tags": Document{"$each": []string{"new", "sale", "sale"}}},
+	})
+	assert.NoError(t, err)
+
+	// $pull with a query condition, $pullAll and $pop
+	_, err = mockDocDB.UpdateOne("carts", filter, Document{
+		"$pull":    Document{"scores": Document{"$gte": 7}},
+		"$pullAll": Document{"tags": []string{"new"}},
+		"$pop":     Document{"audit": 1},
+	})
+	assert.NoError(t, err)
+
+	results, err := mockDocDB.FindDocument("carts", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	cart := results[0]
+	items := cart["items"].([]interface{})
+	assert.Equal(t, 3, len(items))
+	assert.Equal(t, "b", items[0].(map[string]interface{})["sku"])
+	assert.Equal(t, "c", items[1].(map[string]interface{})["sku"])
+	assert.Equal(t, "a", items[2].(map[string]interface{})["sku"])
+	assert.Equal(t, []interface{}{"sale"}, cart["tags"])
+	assert.Equal(t, []interface{}{3, 2}, cart["scores"])
+	assert.Equal(t, []interface{}{"opened"}, cart["audit"])
+
+	// $pull with a query on embedded documents
+	_, err = mockDocDB.UpdateOne("carts", filter, Document{"$pull": Document{"items": Document{"qty": Document{"$lt": 4}}}})
+	assert.NoError(t, err)
+	results, err = mockDocDB.FindDocument("carts", filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results[0]["items"].([]interface{})))
+
+	// $push creates a missing array but refuses non-array fields
+	_, err = mockDocDB.UpdateOne("carts", filter, Document{"$push": Document{"history": "x"}})
+	assert.NoError(t, err)
+	_, err = mockDocDB.UpdateOne("carts", filter, Document{"$push": Document{"cartID": "x"}})
+	assert.Error(t, err)
+}
+
+func TestUpdateWithPositionalOperators(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	doc := loadJSONFixture("testdata/sample_transaction.json", t)
+	_, err := mockDocDB.InsertDocument("transactions", doc)
+	assert.NoError(t, err)
+	itemsOf := func() []interface{} {
+		results, err := mockDocDB.FindDocument("transactions", Document{"ID": "txn001"})
+		assert.NoError(t, err)
+		return results[0]["Items"].([]interface{})
+	}
+
+	// $ refers to the element matched by the filter
+	_, err = mockDocDB.UpdateOne("transactions",
+		Document{"ID": "txn001", "Items.ProductID": "prod002"},
+		Document{"$inc": Document{"Items.$.Quantity": 3}})
+	assert.NoError(t, err)
+	items := itemsOf()
+	assert.Equal(t, 1.0, items[0].(map[string]interface{})["Quantity"])
+	assert.Equal(t, 5.0, items[1].(map[string]interface{})["Quantity"])
+
+	// $ also follows $elemMatch
+	_, err = mockDocDB.UpdateOne("transactions",
+		Document{"Items": Document{"$elemMatch": Document{"Quantity": Document{"$lt": 2}}}},
+		Document{"$set": Document{"Items.$.Backordered": true}})
+	assert.NoError(t, err)
+	assert.Equal(t, true, itemsOf()[0].(map[string]interface{})["Backordered"])
+
+	// $[] updates every element
+	_, err = mockDocDB.UpdateMany("transactions", Document{"ID": "txn001"},
+		Document{"$mul": Document{"Items.$[].Price": 2}})
+	assert.NoError(t, err)
+	items = itemsOf()
+	assert.Equal(t, 100.5, items[0].(map[string]interface{})["Price"])
+	assert.Equal(t, 100.5, items[1].(map[string]interface{})["Price"])
+
+	// $[identifier] updates the elements matching its array filter
+	_, err = mockDocDB.UpdateOne("transactions", Document{"ID": "txn001"},
+		Document{"$set": Document{"Items.$[item].Price": 10.0}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			Document{"item.Quantity": Document{"$gte": 5}},
+		}}))
+	assert.NoError(t, err)
+	items = itemsOf()
+	assert.Equal(t, 100.5, items[0].(map[string]interface{})["Price"])
+	assert.Equal(t, 10.0, items[1].(map[string]interface{})["Price"])
+
+	// Misuse is reported
+	_, err = mockDocDB.UpdateOne("transactions", Document{"ID": "txn001"},
+		Document{"$set": Document{"Items.$.Price": 1}})
+	assert.Error(t, err)
+	_, err = mockDocDB.UpdateOne("transactions", Document{"ID": "txn001"},
+		Document{"$set": Document{"Items.$[missing].Price": 1}})
+	assert.Error(t, err)
+	_, err = mockDocDB.UpdateOne("transactions", Document{"ID": "txn001"},
+		Document{"$set": Document{"Status": "Paid"}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{Document{"unused": 1}}}))
+	assert.Error(t, err)
+}
+
+func TestUpdateOneWithUpsert(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	filter := Document{"email": "ada@example.com", "profile.plan": Document{"$eq": "free"}, "age": Document{"$gt": 18}}
+	update := Document{
+		"$set":         Document{"lastSeen": "today"},
+		"$setOnInsert": Document{"createdBy": "signup"},
+		"$inc":         Document{"logins": 1},
+	}
+
+	// Nothing matches without upsert: no error, nothing inserted
+	result, err := mockDocDB.UpdateOne("users", filter, update)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result.MatchedCount)
+	assert.Nil(t, result.UpsertedID)
+
+	// The first upsert inserts a document built from the filter's equalities
+	result, err = mockDocDB.UpdateOne("users", filter, update, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result.MatchedCount)
+	assert.Equal(t, int64(1), result.UpsertedCount)
+	assert.IsType(t, primitive.ObjectID{}, result.UpsertedID)
+
+	results, err := mockDocDB.FindDocument("users", Document{"_id": result.UpsertedID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	user := results[0]
+	assert.Equal(t, "ada@example.com", user["email"])
+	assert.Equal(t, map[string]interface{}{"plan": "free"}, user["profile"])
+	assert.NotContains(t, user, "age")
+	assert.Equal(t, "signup", user["createdBy"])
+	assert.Equal(t, 1, user["logins"])
+
+	// The second one updates it and leaves $setOnInsert fields alone
+	_, err = mockDocDB.UpdateOne("users", Document{"email": "ada@example.com"}, Document{"$set": Document{"createdBy": "admin"}})
+	assert.NoError(t, err)
+	result, err = mockDocDB.UpdateOne("users", Document{"email": "ada@example.com"}, update, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), result.MatchedCount)
+	assert.Equal(t, int64(0), result.UpsertedCount)
+	assert.Nil(t, result.UpsertedID)
+	results, err = mockDocDB.FindDocument("users", Document{"email": "ada@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "admin", results[0]["createdBy"])
+	assert.Equal(t, 2, results[0]["logins"])
+
+	// A caller-chosen _id in the filter is kept
+	result, err = mockDocDB.UpdateMany("users", Document{"_id": "user-2"}, Document{"$set": Document{"email": "bob@example.com"}}, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "user-2", result.UpsertedID)
+
+	// A numeric _id keeps its type, as it does on insert, and so do the other equality fields
+	result, err = mockDocDB.UpdateOne("users", Document{"_id": 7, "tier": int32(2)}, Document{"$set": Document{"email": "cy@example.com"}}, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, result.UpsertedID)
+	results, err = mockDocDB.FindDocument("users", Document{"_id": 7})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, Document{"_id": 7, "tier": int32(2), "email": "cy@example.com"}, results[0])
+}
+
+func TestReplaceOne(t *testing.T) {
+	mockConfig := &MockConfig{SimulateLatency: false, ErrorMode: false}
+	mockDocDB := NewMockDocDB(mockConfig)
+
+	id := primitive.NewObjectID()
+	_, err := mockDocDB.InsertDocument("orders", Document{"_id": id, "version": 1, "items": []interface{}{"a"}, "note": "rush"})
+	assert.NoError(t, err)
+
+	// An optimistic version check replaces the document once
+	replacement := Document{"version": 2, "items": []interface{}{"a", "b"}}
+	result, err := mockDocDB.ReplaceOne("orders", Document{"_id": id, "version": 1}, replacement)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), result.MatchedCount)
+	assert.Equal(t, int64(1), result.ModifiedCount)
+
+	result, err = mockDocDB.ReplaceOne("orders", Document{"_id": id, "version": 1}, Document{"version": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result.MatchedCount)
+
+	// The _id is kept and the fields not in the replacement are gone
+	results, err := mockDocDB.FindDocument("orders", Document{"_id": id})
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{{"_id": id, "version": 2, "items": []interface{}{"a", "b"}}}, results)
+
+	// Replacing with the same content modifies nothing, and a matching _id is allowed
+	result, err = mockDocDB.ReplaceOne("orders", Document{"_id": id}, Document{"_id": id, "version": 2, "items": []interface{}{"a", "b"}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), result.MatchedCount)
+	assert.Equal(t, int64(0), result.ModifiedCount)
+
+	// Update operators and a different _id are rejected
+	_, err = mockDocDB.ReplaceOne("orders", Document{"_id": id}, Document{"$set": Document{"version": 3}})
+	assert.Error(t, err)
+	_, err = mockDocDB.ReplaceOne("orders", Document{"_id": "missing"}, Document{"version": 1, "$inc": Document{"version": 1}})
+	assert.Error(t, err)
+	_, err = mockDocDB.ReplaceOne("orders", Document{"_id": id}, Document{"_id": primitive.NewObjectID(), "version": 3})
+	assert.Error(t, err)
+
+	// An upsert inserts the replacement with the _id from the filter
+	result, err = mockDocDB.ReplaceOne("orders", Document{"_id": "o-2", "version": 1}, Document{"version": 1, "items": []interface{}{}},
+		options.Replace().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result.MatchedCount)
+	assert.Equal(t, int64(1), result.UpsertedCount)
+	assert.Equal(t, "o-2", result.UpsertedID)
+	results, err = mockDocDB.FindDocument("orders", Document{"_id": "o-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{{"_id": "o-2", "version": 1, "items": []interface{}{}}}, results)
+
+	// A numeric _id from the filter keeps its type, as it does on insert
+	result, err = mockDocDB.ReplaceOne("orders", Document{"_id": 8}, Document{"version": 1}, options.Replace().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, result.UpsertedID)
+	results, err = mockDocDB.FindDocument("orders", Document{"_id": 8})
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{{"_id": 8, "version": 1}}, results)
+
+	// Without an _id anywhere an ObjectID is generated
+	result, err = mockDocDB.ReplaceOne("orders", Document{"version": 9}, Document{"version": 9}, options.Replace().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.IsType(t, primitive.ObjectID{}, result.UpsertedID)
+	count, err := mockDocDB.CountDocuments("orders", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+}